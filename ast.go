@@ -41,6 +41,26 @@ const (
 	NodeIf
 	NodeElseIf
 	NodeFor
+	NodeAttr
+	NodeCall
+	NodeTuple
+	NodeBlock
+	NodeExtends
+	NodeFilter
+	NodeKeyword
+	NodeFilterBlock
+	NodeTest
+	NodeCompare
+	NodeLogical
+	NodeConcat
+	NodeSlice
+	NodeMacro
+	NodeCallBlock
+	NodeInclude
+	NodeImport
+	NodeFrom
+	NodeAutoescape
+	NodeNone
 )
 
 // This is a stack of nodes starting at a position.  It has the default NodeType
@@ -160,7 +180,16 @@ type BoolNode struct {
 }
 
 func (s *BoolNode) Copy() Node     { return &BoolNode{s.NodeType, s.Pos, s.Value} }
-func (s *BoolNode) String() string { return fmt.Sprintf(`%s`, s.Value) }
+func (s *BoolNode) String() string { return fmt.Sprintf(`%t`, s.Value) }
+
+// NoneNode is the literal `none`, which evaluates to nil.
+type NoneNode struct {
+	NodeType
+	Pos
+}
+
+func (n *NoneNode) Copy() Node     { return &NoneNode{n.NodeType, n.Pos} }
+func (n *NoneNode) String() string { return "none" }
 
 type IntegerNode struct {
 	NodeType
@@ -191,10 +220,17 @@ func newUnaryNode(val Node, unary item) *UnaryNode {
 	return &UnaryNode{NodeUnary, val.Position(), val, unary}
 }
 
-func (u *UnaryNode) Copy() Node     { return &UnaryNode{u.NodeType, u.Pos, u.Value, u.Unary} }
-func (u *UnaryNode) String() string { return fmt.Sprintf("%s%s", u.Unary.val, u.Value) }
+func (u *UnaryNode) Copy() Node { return &UnaryNode{u.NodeType, u.Pos, u.Value, u.Unary} }
 
-// newLiteral creates a new string, integer, or float node depending on itemType
+func (u *UnaryNode) String() string {
+	if u.Unary.typ == tokenNot {
+		return fmt.Sprintf("not %s", u.Value)
+	}
+	return fmt.Sprintf("%s%s", u.Unary.val, u.Value)
+}
+
+// newLiteral creates a new string, integer, float, bool or none node depending
+// on itemType
 func newLiteral(pos Pos, typ itemType, val string) Node {
 	switch typ {
 	case tokenFloat:
@@ -213,11 +249,9 @@ func newLiteral(pos Pos, typ itemType, val string) Node {
 	case tokenString:
 		return &StringNode{NodeString, pos, val}
 	case tokenBool:
-		var v bool
-		if val == "true" {
-			v = true
-		}
-		return &BoolNode{NodeBool, pos, v}
+		return &BoolNode{NodeBool, pos, val == "true" || val == "True"}
+	case tokenNone:
+		return &NoneNode{NodeNone, pos}
 	}
 	panic(fmt.Sprint("unexpected literal type ", typ))
 }
@@ -242,6 +276,8 @@ func (a *AddExpr) Copy() Node {
 	return newAddExpr(a.lhs, a.rhs, a.operator)
 }
 
+// MulExpr is a multiplicative expression using `*`, `/`, `//` or `%`, or a
+// power expression using `**`.
 type MulExpr struct {
 	NodeType
 	Pos
@@ -262,6 +298,287 @@ func (m *MulExpr) Copy() Node {
 	return newMulExpr(m.lhs, m.rhs, m.operator)
 }
 
+// ConcatExpr is a string concatenation using `~`.
+type ConcatExpr struct {
+	NodeType
+	Pos
+	lhs      Node
+	rhs      Node
+	operator item
+}
+
+func newConcatExpr(lhs, rhs Node, operator item) *ConcatExpr {
+	return &ConcatExpr{NodeConcat, lhs.Position(), lhs, rhs, operator}
+}
+
+func (c *ConcatExpr) String() string {
+	return fmt.Sprintf("%s ~ %s", c.lhs, c.rhs)
+}
+
+func (c *ConcatExpr) Copy() Node {
+	return newConcatExpr(c.lhs.Copy(), c.rhs.Copy(), c.operator)
+}
+
+// CompareExpr is a comparison, or a chain of comparisons like `a < b < c`
+// which is true only if each comparison in the chain is true.
+type CompareExpr struct {
+	NodeType
+	Pos
+	lhs Node
+	ops []compareOp
+}
+
+// compareOp is one comparison in a chain, against the previous operand.
+type compareOp struct {
+	operator item
+	rhs      Node
+}
+
+func newCompareExpr(lhs Node) *CompareExpr {
+	return &CompareExpr{NodeType: NodeCompare, Pos: lhs.Position(), lhs: lhs}
+}
+
+func (c *CompareExpr) append(operator item, rhs Node) {
+	c.ops = append(c.ops, compareOp{operator, rhs})
+}
+
+func (c *CompareExpr) String() string {
+	b := new(bytes.Buffer)
+	fmt.Fprint(b, c.lhs)
+	for _, op := range c.ops {
+		fmt.Fprintf(b, " %s %s", op.operator.val, op.rhs)
+	}
+	return b.String()
+}
+
+func (c *CompareExpr) Copy() Node {
+	n := newCompareExpr(c.lhs.Copy())
+	for _, op := range c.ops {
+		n.append(op.operator, op.rhs.Copy())
+	}
+	return n
+}
+
+// LogicalExpr is a short-circuiting boolean expression using `and` or `or`.
+type LogicalExpr struct {
+	NodeType
+	Pos
+	lhs      Node
+	rhs      Node
+	operator item
+}
+
+func newLogicalExpr(lhs, rhs Node, operator item) *LogicalExpr {
+	return &LogicalExpr{NodeLogical, lhs.Position(), lhs, rhs, operator}
+}
+
+func (l *LogicalExpr) String() string {
+	return fmt.Sprintf("%s %s %s", l.lhs, l.operator.val, l.rhs)
+}
+
+func (l *LogicalExpr) Copy() Node {
+	return newLogicalExpr(l.lhs.Copy(), l.rhs.Copy(), l.operator)
+}
+
+// AttrExpr is an attribute lookup, ie `value.name`.
+type AttrExpr struct {
+	NodeType
+	Pos
+	Value Node
+	Name  string
+}
+
+func newAttrExpr(val Node, name string) *AttrExpr {
+	return &AttrExpr{NodeAttr, val.Position(), val, name}
+}
+
+func (a *AttrExpr) String() string {
+	return fmt.Sprintf("%s.%s", a.Value, a.Name)
+}
+
+func (a *AttrExpr) Copy() Node {
+	return newAttrExpr(a.Value.Copy(), a.Name)
+}
+
+// CallExpr is a call of a callable value with a list of arguments.
+// CallExpr is a call of a function or method, eg. `f(a, b=1)`.
+type CallExpr struct {
+	NodeType
+	Pos
+	Func   Node
+	Args   []Node
+	Kwargs []*KeywordArg
+}
+
+func newCallExpr(fn Node) *CallExpr {
+	return &CallExpr{NodeType: NodeCall, Pos: fn.Position(), Func: fn}
+}
+
+func (c *CallExpr) String() string {
+	b := new(bytes.Buffer)
+	fmt.Fprint(b, c.Func)
+	writeArgs(b, c.Args, c.Kwargs)
+	return b.String()
+}
+
+func (c *CallExpr) Copy() Node {
+	n := newCallExpr(c.Func.Copy())
+	n.Args, n.Kwargs = copyArgs(c.Args, c.Kwargs)
+	return n
+}
+
+// KeywordArg is a keyword argument in an argument list, ie `name=value`.
+type KeywordArg struct {
+	NodeType
+	Pos
+	Name  string
+	Value Node
+}
+
+func newKeywordArg(pos Pos, name string, value Node) *KeywordArg {
+	return &KeywordArg{NodeKeyword, pos, name, value}
+}
+
+func (k *KeywordArg) String() string { return fmt.Sprintf("%s=%s", k.Name, k.Value) }
+func (k *KeywordArg) Copy() Node     { return newKeywordArg(k.Pos, k.Name, k.Value.Copy()) }
+
+// FilterExpr is the application of a filter to a value, ie. `value|name`,
+// with optional arguments.  Within a {% filter %} block, Value is nil.
+type FilterExpr struct {
+	NodeType
+	Pos
+	Value  Node
+	Name   string
+	Args   []Node
+	Kwargs []*KeywordArg
+}
+
+func newFilterExpr(pos Pos, value Node, name string) *FilterExpr {
+	return &FilterExpr{NodeType: NodeFilter, Pos: pos, Value: value, Name: name}
+}
+
+func (f *FilterExpr) String() string {
+	b := new(bytes.Buffer)
+	if f.Value != nil {
+		fmt.Fprintf(b, "%s|", f.Value)
+	}
+	b.WriteString(f.Name)
+	if len(f.Args) > 0 || len(f.Kwargs) > 0 {
+		writeArgs(b, f.Args, f.Kwargs)
+	}
+	return b.String()
+}
+
+func (f *FilterExpr) Copy() Node {
+	n := newFilterExpr(f.Pos, nil, f.Name)
+	if f.Value != nil {
+		n.Value = f.Value.Copy()
+	}
+	n.Args, n.Kwargs = copyArgs(f.Args, f.Kwargs)
+	return n
+}
+
+// writeArgs writes a parenthesized argument list to b.
+func writeArgs(b *bytes.Buffer, args []Node, kwargs []*KeywordArg) {
+	b.WriteString("(")
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprint(b, arg)
+	}
+	for i, kwarg := range kwargs {
+		if i > 0 || len(args) > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprint(b, kwarg)
+	}
+	b.WriteString(")")
+}
+
+// copyArgs deep copies an argument list.
+func copyArgs(args []Node, kwargs []*KeywordArg) ([]Node, []*KeywordArg) {
+	var a []Node
+	var kw []*KeywordArg
+	for _, arg := range args {
+		a = append(a, arg.Copy())
+	}
+	for _, kwarg := range kwargs {
+		kw = append(kw, kwarg.Copy().(*KeywordArg))
+	}
+	return a, kw
+}
+
+// TestExpr applies a test to a value, eg. `n is divisibleby(3)` or
+// `x is not defined`.
+type TestExpr struct {
+	NodeType
+	Pos
+	Value   Node
+	Name    string
+	Negated bool
+	Args    []Node
+	Kwargs  []*KeywordArg
+}
+
+func newTestExpr(pos Pos, value Node, name string, negated bool) *TestExpr {
+	return &TestExpr{NodeType: NodeTest, Pos: pos, Value: value, Name: name, Negated: negated}
+}
+
+func (t *TestExpr) String() string {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "%s is ", t.Value)
+	if t.Negated {
+		b.WriteString("not ")
+	}
+	b.WriteString(t.Name)
+	if len(t.Args) > 0 || len(t.Kwargs) > 0 {
+		writeArgs(b, t.Args, t.Kwargs)
+	}
+	return b.String()
+}
+
+func (t *TestExpr) Copy() Node {
+	n := newTestExpr(t.Pos, t.Value.Copy(), t.Name, t.Negated)
+	n.Args, n.Kwargs = copyArgs(t.Args, t.Kwargs)
+	return n
+}
+
+// TupleNode is a comma separated sequence of expressions.  It is used as the
+// target of assignments which unpack a sequence, eg. `for k, v in map`, and
+// for tuple literals like `(a, b)`.
+type TupleNode struct {
+	NodeType
+	Pos
+	Nodes []Node
+}
+
+func newTuple(pos Pos) *TupleNode {
+	return &TupleNode{NodeType: NodeTuple, Pos: pos}
+}
+
+func (t *TupleNode) append(n Node) { t.Nodes = append(t.Nodes, n) }
+func (t *TupleNode) len() int      { return len(t.Nodes) }
+
+func (t *TupleNode) String() string {
+	b := new(bytes.Buffer)
+	for i, n := range t.Nodes {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprint(b, n)
+	}
+	return b.String()
+}
+
+func (t *TupleNode) Copy() Node {
+	n := newTuple(t.Pos)
+	for _, elem := range t.Nodes {
+		n.append(elem.Copy())
+	}
+	return n
+}
+
 // complex literals
 
 type MapExpr struct {
@@ -339,23 +656,83 @@ func (i *IndexExpr) Copy() Node {
 	return newIndexExpr(i.Value, i.Index)
 }
 
+// A SliceExpr is a python style slice, `value[start:stop:step]`.  Any of
+// Start, Stop and Step may be nil if they were omitted.
+type SliceExpr struct {
+	NodeType
+	Pos
+	Value Node
+	Start Node
+	Stop  Node
+	Step  Node
+}
+
+func newSliceExpr(val, start, stop, step Node) *SliceExpr {
+	return &SliceExpr{NodeSlice, val.Position(), val, start, stop, step}
+}
+
+func (s *SliceExpr) String() string {
+	str := func(n Node) string {
+		if n == nil {
+			return ""
+		}
+		return n.String()
+	}
+	if s.Step == nil {
+		return fmt.Sprintf("%s[%s:%s]", s.Value, str(s.Start), str(s.Stop))
+	}
+	return fmt.Sprintf("%s[%s:%s:%s]", s.Value, str(s.Start), str(s.Stop), str(s.Step))
+}
+
+func (s *SliceExpr) Copy() Node {
+	return newSliceExpr(s.Value, s.Start, s.Stop, s.Step)
+}
+
 // block types
+// SetNode assigns to Target, which is a name, a tuple of names to unpack
+// into, or a namespace attribute like `ns.count`.  The assigned value is
+// either the expression Value, or the rendered Body of a block assignment
+// passed through any Filters.
 type SetNode struct {
 	NodeType
 	Pos
-	lhs Node
-	rhs Node
+	Target  Node
+	Value   Node
+	Body    *ListNode
+	Filters []*FilterExpr
 }
 
-func newSet(pos Pos, lhs, rhs Node) *SetNode {
-	return &SetNode{NodeSet, pos, lhs, rhs}
+func newSet(pos Pos, target, value Node) *SetNode {
+	return &SetNode{NodeType: NodeSet, Pos: pos, Target: target, Value: value}
 }
 
 // FIXME: environment needed to really recreate this as it requires block
 // begin and end tags, which we don't technically know
-func (s *SetNode) String() string { return fmt.Sprintf("{%% set %s = %s %%}", s.lhs, s.rhs) }
+func (s *SetNode) String() string {
+	if s.Body == nil {
+		return fmt.Sprintf("{%% set %s = %s %%}", s.Target, s.Value)
+	}
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "{%% set %s", s.Target)
+	for _, filter := range s.Filters {
+		fmt.Fprintf(b, "|%s", filter)
+	}
+	fmt.Fprintf(b, " %%}%s{%% endset %%}", s.Body)
+	return b.String()
+}
+
 func (s *SetNode) Copy() Node {
-	return newSet(s.Pos, s.lhs.Copy(), s.rhs.Copy())
+	n := newSet(s.Pos, s.Target.Copy(), nil)
+	if s.Value != nil {
+		n.Value = s.Value.Copy()
+	}
+	if s.Body != nil {
+		n.Body = s.Body.CopyList()
+	}
+	for _, filter := range s.Filters {
+		n.Filters = append(n.Filters, filter.Copy().(*FilterExpr))
+	}
+	return n
 }
 
 // A ConditionalNode is a node that has a guard and a body.  If the guard evals
@@ -427,7 +804,7 @@ func (i *IfBlockNode) String() string {
 }
 func (i *IfBlockNode) Copy() Node {
 	n := newIf(i.Pos)
-	n.Conditionals = make([]Node, len(i.Conditionals))
+	n.Conditionals = make([]Node, 0, len(i.Conditionals))
 	for _, e := range i.Conditionals {
 		n.Conditionals = append(n.Conditionals, e.Copy())
 	}
@@ -437,12 +814,16 @@ func (i *IfBlockNode) Copy() Node {
 	return n
 }
 
+// ForNode represents a {% for %} block.  ForExpr is the loop target, which
+// is either a LookupNode or a TupleNode of LookupNodes to unpack each item
+// into.  `Else` is rendered if the iterable is empty, and can be nil.
 type ForNode struct {
 	NodeType
 	Pos
 	ForExpr Node
 	InExpr  Node
 	Body    Node
+	Else    Node
 }
 
 func newFor(pos Pos) *ForNode {
@@ -452,6 +833,9 @@ func newFor(pos Pos) *ForNode {
 // FIXME: This should use the environment's begin and end tags, which we
 // don't have down at this level...
 func (f *ForNode) String() string {
+	if f.Else != nil {
+		return fmt.Sprintf("{%% for %s in %s %%}%s{%% else %%}%s{%% endfor %%}", f.ForExpr, f.InExpr, f.Body, f.Else)
+	}
 	return fmt.Sprintf("{%% for %s in %s %%}%s{%% endfor %%}", f.ForExpr, f.InExpr, f.Body)
 }
 func (f *ForNode) Copy() Node {
@@ -459,9 +843,14 @@ func (f *ForNode) Copy() Node {
 	n.ForExpr = f.ForExpr.Copy()
 	n.InExpr = f.InExpr.Copy()
 	n.Body = f.Body.Copy()
+	if f.Else != nil {
+		n.Else = f.Else.Copy()
+	}
 	return n
 }
 
+// BlockNode is a named {% block %}, which can be overridden by templates
+// which extend the template it is defined in.
 type BlockNode struct {
 	NodeType
 	Pos
@@ -469,49 +858,294 @@ type BlockNode struct {
 	Body Node
 }
 
+func newBlock(pos Pos, name string) *BlockNode {
+	return &BlockNode{NodeType: NodeBlock, Pos: pos, Name: name}
+}
+
 func (b *BlockNode) String() string {
-	return fmt.Sprintf("{% block %s %}%s{% endblock %}", b.Name, b.Body)
+	return fmt.Sprintf("{%% block %s %%}%s{%% endblock %%}", b.Name, b.Body)
 }
 
 func (b *BlockNode) Copy() Node {
 	return &BlockNode{b.NodeType, b.Pos, b.Name, b.Body.Copy()}
 }
 
+// FilterBlockNode is a {% filter %} block, whose rendered body is passed
+// through a chain of filters.
+type FilterBlockNode struct {
+	NodeType
+	Pos
+	Filters []*FilterExpr
+	Body    Node
+}
+
+func newFilterBlock(pos Pos) *FilterBlockNode {
+	return &FilterBlockNode{NodeType: NodeFilterBlock, Pos: pos}
+}
+
+func (f *FilterBlockNode) String() string {
+	b := new(bytes.Buffer)
+	b.WriteString("{% filter ")
+	for i, filter := range f.Filters {
+		if i > 0 {
+			b.WriteString("|")
+		}
+		fmt.Fprint(b, filter)
+	}
+	fmt.Fprintf(b, " %%}%s{%% endfilter %%}", f.Body)
+	return b.String()
+}
+
+func (f *FilterBlockNode) Copy() Node {
+	n := newFilterBlock(f.Pos)
+	for _, filter := range f.Filters {
+		n.Filters = append(n.Filters, filter.Copy().(*FilterExpr))
+	}
+	n.Body = f.Body.Copy()
+	return n
+}
+
+// Import is a name imported by a {% from %} tag, and the name it is
+// assigned to, which is the same unless it is renamed with `as`.
 type Import struct {
 	Name string
 	As   string
 }
 
+// ExtendsNode is an {% extends %} tag.  Template is an expression which
+// evaluates to the name of the parent template.
 type ExtendsNode struct {
 	NodeType
 	Pos
+	Template Node
+}
+
+func newExtends(pos Pos, tmpl Node) *ExtendsNode {
+	return &ExtendsNode{NodeExtends, pos, tmpl}
 }
+
+func (e *ExtendsNode) String() string { return fmt.Sprintf("{%% extends %s %%}", e.Template) }
+func (e *ExtendsNode) Copy() Node     { return newExtends(e.Pos, e.Template.Copy()) }
+
 type PrintNode struct {
 	NodeType
 	Pos
 }
+
+// MacroNode is a {% macro name(params) %}...{% endmacro %} definition.  The
+// last len(Defaults) parameters have default values.
 type MacroNode struct {
 	NodeType
 	Pos
+	Name     string
+	Params   []string
+	Defaults []Node
+	Body     *ListNode
+	// Varargs and Kwargs are whether Body refers to `varargs` and `kwargs`,
+	// and so whether the macro accepts extra arguments.
+	Varargs bool
+	Kwargs  bool
+}
+
+func newMacro(pos Pos, name string) *MacroNode {
+	return &MacroNode{NodeType: NodeMacro, Pos: pos, Name: name}
 }
+
+func (m *MacroNode) String() string {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "{%% macro %s", m.Name)
+	writeParams(b, m.Params, m.Defaults)
+	fmt.Fprintf(b, " %%}%s{%% endmacro %%}", m.Body)
+	return b.String()
+}
+
+func (m *MacroNode) Copy() Node {
+	n := newMacro(m.Pos, m.Name)
+	n.Params = append(n.Params, m.Params...)
+	for _, d := range m.Defaults {
+		n.Defaults = append(n.Defaults, d.Copy())
+	}
+	n.Body = m.Body.CopyList()
+	n.Varargs, n.Kwargs = m.Varargs, m.Kwargs
+	return n
+}
+
+// writeParams writes a parenthesized parameter list to b.
+func writeParams(b *bytes.Buffer, params []string, defaults []Node) {
+	b.WriteString("(")
+	first := len(params) - len(defaults)
+	for i, p := range params {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(p)
+		if i >= first {
+			fmt.Fprintf(b, "=%s", defaults[i-first])
+		}
+	}
+	b.WriteString(")")
+}
+
+// IncludeNode is an {% include %} tag.  Template evaluates to the name of
+// the included template, or a list of names of which the first that exists
+// is included.
 type IncludeNode struct {
 	NodeType
 	Pos
+	Template      Node
+	IgnoreMissing bool
+	WithContext   bool
+}
+
+func newInclude(pos Pos, tmpl Node) *IncludeNode {
+	return &IncludeNode{NodeType: NodeInclude, Pos: pos, Template: tmpl, WithContext: true}
 }
 
+func (i *IncludeNode) String() string {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "{%% include %s", i.Template)
+	if i.IgnoreMissing {
+		b.WriteString(" ignore missing")
+	}
+	if !i.WithContext {
+		b.WriteString(" without context")
+	}
+	b.WriteString(" %}")
+	return b.String()
+}
+
+func (i *IncludeNode) Copy() Node {
+	n := newInclude(i.Pos, i.Template.Copy())
+	n.IgnoreMissing, n.WithContext = i.IgnoreMissing, i.WithContext
+	return n
+}
+
+// FromNode is a {% from module import name as alias, ... %} tag, which
+// imports names from the module template Module evaluates to.
 type FromNode struct {
 	NodeType
 	Pos
-	Module  string
-	Imports []Import
+	Module      Node
+	Imports     []Import
+	WithContext bool
 }
+
+func newFrom(pos Pos, module Node) *FromNode {
+	return &FromNode{NodeType: NodeFrom, Pos: pos, Module: module}
+}
+
+func (f *FromNode) String() string {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "{%% from %s import ", f.Module)
+	for i, imp := range f.Imports {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(imp.Name)
+		if imp.As != imp.Name {
+			fmt.Fprintf(b, " as %s", imp.As)
+		}
+	}
+	if f.WithContext {
+		b.WriteString(" with context")
+	}
+	b.WriteString(" %}")
+	return b.String()
+}
+
+func (f *FromNode) Copy() Node {
+	n := newFrom(f.Pos, f.Module.Copy())
+	n.Imports = append(n.Imports, f.Imports...)
+	n.WithContext = f.WithContext
+	return n
+}
+
+// ImportNode is an {% import module as name %} tag, which assigns the
+// module template Module evaluates to to name.
 type ImportNode struct {
 	NodeType
 	Pos
-	Module string
-	Body   Import
+	Module      Node
+	As          string
+	WithContext bool
+}
+
+func newImport(pos Pos, module Node, as string) *ImportNode {
+	return &ImportNode{NodeType: NodeImport, Pos: pos, Module: module, As: as}
 }
+
+func (i *ImportNode) String() string {
+	if i.WithContext {
+		return fmt.Sprintf("{%% import %s as %s with context %%}", i.Module, i.As)
+	}
+	return fmt.Sprintf("{%% import %s as %s %%}", i.Module, i.As)
+}
+
+func (i *ImportNode) Copy() Node {
+	n := newImport(i.Pos, i.Module.Copy(), i.As)
+	n.WithContext = i.WithContext
+	return n
+}
+
+// CallNode is a {% call(params) macro(args) %}...{% endcall %} block, which
+// calls a macro with its body available to the macro as `caller()`.
 type CallNode struct {
 	NodeType
 	Pos
+	Params   []string
+	Defaults []Node
+	Call     *CallExpr
+	Body     *ListNode
+	// Varargs and Kwargs are whether Body refers to `varargs` and `kwargs`,
+	// and so whether caller accepts extra arguments.
+	Varargs bool
+	Kwargs  bool
+}
+
+func newCallBlock(pos Pos, call *CallExpr) *CallNode {
+	return &CallNode{NodeType: NodeCallBlock, Pos: pos, Call: call}
+}
+
+func (c *CallNode) String() string {
+	b := new(bytes.Buffer)
+	b.WriteString("{% call")
+	if len(c.Params) > 0 {
+		writeParams(b, c.Params, c.Defaults)
+	}
+	fmt.Fprintf(b, " %s %%}%s{%% endcall %%}", c.Call, c.Body)
+	return b.String()
+}
+
+func (c *CallNode) Copy() Node {
+	n := newCallBlock(c.Pos, c.Call.Copy().(*CallExpr))
+	n.Params = append(n.Params, c.Params...)
+	for _, d := range c.Defaults {
+		n.Defaults = append(n.Defaults, d.Copy())
+	}
+	n.Body = c.Body.CopyList()
+	n.Varargs, n.Kwargs = c.Varargs, c.Kwargs
+	return n
+}
+
+// AutoescapeNode is an {% autoescape %} block, which turns autoescaping on
+// or off for its body depending on the value of Enabled.
+type AutoescapeNode struct {
+	NodeType
+	Pos
+	Enabled Node
+	Body    *ListNode
+}
+
+func newAutoescape(pos Pos, enabled Node) *AutoescapeNode {
+	return &AutoescapeNode{NodeType: NodeAutoescape, Pos: pos, Enabled: enabled}
+}
+
+func (a *AutoescapeNode) String() string {
+	return fmt.Sprintf("{%% autoescape %s %%}%s{%% endautoescape %%}", a.Enabled, a.Body)
+}
+
+func (a *AutoescapeNode) Copy() Node {
+	n := newAutoescape(a.Pos, a.Enabled.Copy())
+	n.Body = a.Body.Copy().(*ListNode)
+	return n
 }
@@ -0,0 +1,64 @@
+package jigo
+
+import (
+	"container/list"
+	"sync"
+)
+
+// templateCache is an LRU cache of loaded templates, keyed by name.  It is
+// safe for concurrent use.
+type templateCache struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	name string
+	t    *Template
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the cached template called name, marking it as recently used.
+func (c *templateCache) get(name string) (*Template, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[name]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*cacheEntry).t, true
+	}
+	return nil, false
+}
+
+// add adds a template to the cache, replacing any template already cached
+// under that name.  If the cache holds more than size templates afterwards,
+// the least recently used are evicted.  A size of 0 disables caching, and a
+// negative size means the cache is unbounded.
+func (c *templateCache) add(name string, t *Template, size int) {
+	if size == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[name]; ok {
+		e.Value.(*cacheEntry).t = t
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[name] = c.ll.PushFront(&cacheEntry{name, t})
+	}
+	for size > 0 && c.ll.Len() > size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).name)
+	}
+}
+
+// len returns the number of cached templates.
+func (c *templateCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
@@ -0,0 +1,133 @@
+package jigo
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTemplateCache(t *testing.T) {
+	c := newTemplateCache()
+	a, b, x := &Template{Name: "a"}, &Template{Name: "b"}, &Template{Name: "c"}
+
+	c.add("a", a, 2)
+	c.add("b", b, 2)
+	if got, ok := c.get("a"); !ok || got != a {
+		t.Errorf("expected a to be cached")
+	}
+	// a is now the most recently used, so adding c evicts b
+	c.add("c", x, 2)
+	if _, ok := c.get("b"); ok {
+		t.Errorf("expected b to be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Errorf("expected a to be cached")
+	}
+	if c.len() != 2 {
+		t.Errorf("expected 2 cached templates, got %d", c.len())
+	}
+
+	// replacing an entry does not grow the cache
+	c.add("a", b, 2)
+	if got, _ := c.get("a"); got != b || c.len() != 2 {
+		t.Errorf("expected a to be replaced in place")
+	}
+
+	c = newTemplateCache()
+	c.add("a", a, 0)
+	if c.len() != 0 {
+		t.Errorf("expected a size of 0 to disable caching")
+	}
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprint(i), a, -1)
+	}
+	if c.len() != 100 {
+		t.Errorf("expected an unbounded cache to hold 100 templates, got %d", c.len())
+	}
+}
+
+func TestLoadCacheSize(t *testing.T) {
+	e := NewEnvironment()
+	e.Loader = MapLoader{"a": "a", "b": "b", "c": "c"}
+	e.CacheSize = 2
+
+	a, _ := e.Load("a")
+	e.Load("b")
+	e.Load("c")
+	if again, _ := e.Load("a"); again == a {
+		t.Error("expected a to have been evicted and reloaded")
+	}
+
+	e.CacheSize = 0
+	c, _ := e.Load("c")
+	if again, _ := e.Load("c"); again == c {
+		t.Error("expected templates not to be cached with a CacheSize of 0")
+	}
+}
+
+func TestAutoReload(t *testing.T) {
+	loader := MapLoader{"index.html": "first"}
+	e := NewEnvironment()
+	e.Loader = loader
+
+	render := func() string {
+		tpl, err := e.Load("index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := tpl.Render(m{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	if out := render(); out != "first" {
+		t.Errorf("expected first, got %s", out)
+	}
+	loader["index.html"] = "second"
+	if out := render(); out != "second" {
+		t.Errorf("expected the changed template to be reloaded, got %s", out)
+	}
+
+	e.AutoReload = false
+	loader["index.html"] = "third"
+	if out := render(); out != "second" {
+		t.Errorf("expected the cached template without AutoReload, got %s", out)
+	}
+}
+
+func TestConcurrentLoad(t *testing.T) {
+	loader := MapLoader{}
+	for i := 0; i < 20; i++ {
+		loader[fmt.Sprint(i)] = fmt.Sprintf("{{ name }} %d", i)
+	}
+	e := NewEnvironment()
+	e.Loader = loader
+	e.CacheSize = 10
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				name := fmt.Sprint(i % 20)
+				tpl, err := e.Load(name)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				out, err := tpl.Render(m{"name": "x"})
+				if err != nil || out != "x "+name {
+					t.Errorf("unexpected render of %s: %q, %v", name, out, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := e.templateCache().len(); n > 10 {
+		t.Errorf("expected at most 10 cached templates, got %d", n)
+	}
+}
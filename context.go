@@ -12,6 +12,9 @@ type Context struct {
 	ctx   interface{}
 	kind  reflect.Kind
 	value reflect.Value
+	// policy restricts the fields and methods of struct contexts in
+	// sandboxed environments.
+	policy Policy
 }
 
 // Contexts can be structs or maps, or pointers to these types, but no other type.
@@ -25,25 +28,45 @@ func NewContext(i interface{}) (*Context, error) {
 	c.kind = v.Kind()
 	c.value = v
 	if c.kind != reflect.Map && c.kind != reflect.Struct {
-		return c, fmt.Errorf("Context must be a struct or map, not %s")
+		return c, fmt.Errorf("Context must be a struct or map, not %s", c.kind)
 	}
 	return c, nil
 }
 
+// newScope returns an empty, writable context for temporary variables.
+func newScope() *Context {
+	c, _ := NewContext(map[string]interface{}{})
+	return c
+}
+
+// set sets name to v in a context created by newScope.  Other contexts are
+// read-only, and set is a noop on them.
+func (c *Context) set(name string, v interface{}) {
+	if m, ok := c.ctx.(map[string]interface{}); ok {
+		m[name] = v
+	}
+}
+
 // lookup finds a single name in a single context.  If no name is found, then
 // an empty Value is returned and ok is False.
 func (c Context) lookup(name string) (v reflect.Value, ok bool) {
+	v, ok, _ = c.find(name)
+	return v, ok
+}
+
+// find is like lookup, but also returns a *SecurityError if the context's
+// policy does not allow access to name.
+func (c Context) find(name string) (v reflect.Value, ok bool, err error) {
 	switch c.kind {
 	case reflect.Map:
 		v := c.value.MapIndex(reflect.ValueOf(name))
-		return v, v.IsValid()
+		return v, v.IsValid(), nil
 	case reflect.Struct:
 		// FIXME: reflectx fieldmaps will be much faster but a fair bit more code.
 		// We should use them eventually.
-		v := c.value.FieldByName(name)
-		return v, v.IsValid()
+		return attrValue(reflect.ValueOf(c.ctx), name, c.policy)
 	default:
-		return v, false
+		return v, false, nil
 	}
 }
 
@@ -71,16 +94,26 @@ func (c *contextStack) pop() (ctx *Context) {
 	return ctx
 }
 
+// set sets name to v in the innermost context, which is the scope of the
+// current block, loop or template.
+func (c contextStack) set(name string, v interface{}) {
+	c[len(c)-1].set(name, v)
+}
+
 // lookup finds a name in the context stack.  If no name is found, then an undefined
 // sentinel is returned.
 func (c contextStack) lookup(name string) (v reflect.Value, ok bool) {
-	var ctx *Context
+	v, ok, _ = c.find(name)
+	return v, ok
+}
+
+// find is like lookup, but also returns a *SecurityError if the policy of
+// the context the name is found in does not allow access to it.
+func (c contextStack) find(name string) (v reflect.Value, ok bool, err error) {
 	for i := len(c) - 1; i >= 0; i-- {
-		ctx = c[i]
-		v, ok = ctx.lookup(name)
-		if ok {
-			return v, ok
+		if v, ok, err = c[i].find(name); ok || err != nil {
+			return v, ok, err
 		}
 	}
-	return v, ok
+	return v, false, nil
 }
@@ -2,8 +2,11 @@ package jigo
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"sync"
+	"time"
 )
 
 type Environment struct {
@@ -25,9 +28,67 @@ type Environment struct {
 	LstripBlocks bool
 	// If true, html auto-escaping is enabled by default for all var output.
 	AutoEscape bool
-	// Should the loader attempt to auto reload.
+	// If set, AutoEscapeFunc is called with the name of each template when it
+	// is rendered to decide whether it is autoescaped, instead of AutoEscape.
+	// See AutoEscapeExtensions.
+	AutoEscapeFunc func(name string) bool
+	// If true, autoescaped output is escaped for where it appears in the
+	// HTML, like html/template:  values in attributes, URL attributes,
+	// <script> and <style> elements and event handler and style attributes
+	// are escaped for HTML attributes, URLs, JavaScript and CSS respectively.
+	// Default false.
+	ContextualEscape bool
+	// Determines how undefined values behave.  Default DefaultUndefined.
+	Undefined UndefinedMode
+	// If true, Load checks whether a cached template has changed in its Loader
+	// and reloads it if it has.  Default true.
 	AutoReload bool
 
+	// Limits on rendering, which guard against templates which would
+	// otherwise render for too long or produce too much output.  A limit of 0
+	// is no limit.  Rendering stops with a *LimitError when one is exceeded.
+
+	// The maximum number of bytes of output a render may write.  Output
+	// captured by macros and set blocks, and strings made by filters like
+	// center, are limited to it too.
+	MaxOutput int64
+	// The maximum total number of for loop iterations in a render.
+	MaxIterations int64
+	// The maximum depth of nested macro calls and includes.  Whatever it is
+	// set to, including 0, the depth is limited to 1000, which keeps
+	// recursive templates from overflowing the stack.
+	MaxDepth int
+	// The maximum time a render may take.
+	Timeout time.Duration
+
+	// If set, templates are sandboxed by this policy, which decides the
+	// fields and methods of Go values they may access.  Sandboxed templates
+	// may also only call macros, allowed methods and functions in Globals.
+	// Accessing anything else stops rendering with a *SecurityError.  See
+	// NewSandboxedEnvironment.
+	Sandbox Policy
+
+	// Filters maps names to the functions used in `|` filter expressions and
+	// filter blocks, and defaults to the builtin filters.  A filter is called
+	// with the filtered value as its first argument, followed by any arguments
+	// given in the template.  Its final parameters may be of type Args and
+	// Kwargs to accept extra positional and keyword arguments, and it may
+	// return an error as its last result.
+	Filters map[string]interface{}
+	// Tests maps names to the functions used in `is` test expressions and by
+	// filters like select, and defaults to the builtin tests.  Tests are called
+	// like filters, with the tested value as their first argument, and must
+	// return a bool.
+	Tests map[string]interface{}
+	// Global variables to pass to every template.  Shadowed by actual local contexts.
+	// Defaults to a map holding the builtin `namespace` function.
+	Globals map[string]interface{}
+	// The loader used by Load to find templates by name.
+	Loader Loader
+	// The number of loaded templates to keep in an LRU cache.  If 0, templates
+	// are not cached, and if negative, the cache is unbounded.  Default 50.
+	CacheSize int
+
 	// -- Will not support --
 	// I've decided not to support line statements and line comments, they're unnecessary.
 	// LineStatementPrefix string
@@ -43,32 +104,68 @@ type Environment struct {
 	// as it is being output.  For example can convert `nil` to "".  I think since
 	// Go is statically typed it's unlikely we'll have use for this
 
-	// filters ~ a mapping of names to functions for use in | filters.  Mandira
-	// already supports these, so these should not be too difficult.
+	// extensions ~ not sure these are easily doable with Go.
 
-	// tests ~ a mapping of functions for use with the is operator;  will have to define
-	// a TestFunc interface.
+	// bytecode_cache ~ we're going to do an AST cache which will basically
+	// just be a Gobbed AST.
 
-	// Global variables to pass to every template.  Shadowed by actual local contexts.
-	Globals map[string]interface{}
-	// extensions ~ not sure these are easily doable with Go.
+	mu      sync.Mutex
+	cache   *templateCache     // templates loaded by this environment, by name
+	modules map[string]*module // modules imported without context, by name
+}
 
-	// loader ~ loaders can customize where templates come from, so you can
-	// refer to template paths by say memcached key for an MC loader or fs path
-	// anchored at some root for an FS loader.  These are cool, but will start
-	// with just a built-in FS loader.
+// An UndefinedMode determines what happens when a template refers to a value
+// which does not exist.
+type UndefinedMode int
+
+const (
+	// DefaultUndefined evaluates missing values, keys and out of range indices
+	// to undefined, which renders as an empty string and is false in
+	// conditions.  Using undefined in arithmetic, or getting an attribute or
+	// item of it, is an error.
+	DefaultUndefined UndefinedMode = iota
+	// StrictUndefined makes any use of undefined an error, except testing it
+	// with `is defined` or passing it to the default filter.  Subscripts with
+	// missing keys or out of range indices are also errors.
+	StrictUndefined
+	// ChainableUndefined is like DefaultUndefined, but attributes and items of
+	// undefined are also undefined, so `a.b.c` is undefined if a is.
+	ChainableUndefined
+	// DebugUndefined is like DefaultUndefined, but undefined renders as the
+	// expression which was undefined, eg. `{{ user.name }}`.
+	DebugUndefined
+)
 
-	// cache ~ cache of recently parsed templates.  []Ast?
+// autoescape returns whether the template called name is autoescaped.
+func (e *Environment) autoescape(name string) bool {
+	if e.AutoEscapeFunc != nil {
+		return e.AutoEscapeFunc(name)
+	}
+	return e.AutoEscape
+}
 
-	// cache_size ~ LRU of recently parsed templates, defaults to 50..
-	// will start by keeping all parsed templates, keyed by path & env key
+// A LimitError is returned when a render exceeds one of its environment's
+// limits.
+type LimitError struct {
+	// Limit is the name of the Environment field which was exceeded, eg.
+	// "MaxOutput".
+	Limit string
+	// Value is the value of the limit.
+	Value interface{}
+}
 
-	// bytecode_cache ~ we're going to do an AST cache which will basically
-	// just be a Gobbed AST.
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("template: %s of %v exceeded", e.Limit, e.Value)
+}
+
+// IsLimit reports whether err is the result of a render exceeding a limit.
+func IsLimit(err error) bool {
+	var le *LimitError
+	return errors.As(err, &le)
 }
 
 // sanityCheck checks an environment for possible improper configurations.
-func (e Environment) sanityCheck() error {
+func (e *Environment) sanityCheck() error {
 	if e.CommentStartString == e.BlockStartString || e.CommentStartString == e.VariableStartString || e.BlockStartString == e.VariableStartString {
 		return errors.New("BlockStartString, VariableBlockString, and CommentStartString must be distinct.")
 	}
@@ -76,15 +173,20 @@ func (e Environment) sanityCheck() error {
 }
 
 func NewEnvironment() *Environment {
-	return &Environment{
+	e := &Environment{
 		BlockStartString:    "{%",
 		BlockEndString:      "%}",
 		VariableStartString: "{{",
 		VariableEndString:   "}}",
 		CommentStartString:  "{#",
 		CommentEndString:    "#}",
-		Globals:             make(map[string]interface{}),
+		AutoReload:          true,
+		CacheSize:           50,
+		Globals:             map[string]interface{}{"namespace": builtin{newNamespace}},
 	}
+	e.Filters = builtinFilters(e)
+	e.Tests = builtinTests()
+	return e
 }
 
 // lex returns a new lexer for some source.
@@ -96,6 +198,8 @@ func (e *Environment) lex(source, name, filename string) *lexer {
 		VariableEndString:   e.VariableEndString,
 		CommentStartString:  e.CommentStartString,
 		CommentEndString:    e.CommentEndString,
+		TrimBlocks:          e.TrimBlocks,
+		LstripBlocks:        e.LstripBlocks,
 	}
 	l := &lexer{
 		lexerCfg:   cfg,
@@ -111,8 +215,61 @@ func (e *Environment) lex(source, name, filename string) *lexer {
 	return l
 }
 
-func (e *Environment) Load(path string) (*Template, error) {
-	return nil, nil
+// Load returns the template with the given name from the environment's
+// Loader.  Loaded templates are cached, so the template is only parsed the
+// first time it is loaded unless it is evicted from the cache or, if
+// AutoReload is set, it changes.  Load is safe for concurrent use.
+func (e *Environment) Load(name string) (*Template, error) {
+	cache := e.templateCache()
+	if t, ok := cache.get(name); ok && e.CacheSize != 0 {
+		if !e.AutoReload || t.uptodate == nil || t.uptodate() {
+			return t, nil
+		}
+	}
+	if e.Loader == nil {
+		return nil, &NotFoundError{name}
+	}
+	src, err := e.Loader.Source(name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := e.ParseString(src.Text, name, src.Filename)
+	if err != nil {
+		return nil, err
+	}
+	t.uptodate = src.UpToDate
+	cache.add(name, t, e.CacheSize)
+	return t, nil
+}
+
+// cachedModule returns the module for t if it has been imported before.
+func (e *Environment) cachedModule(t *Template) (*module, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m, ok := e.modules[t.Name]
+	// a module is stale if its template has been reloaded
+	return m, ok && m.t == t
+}
+
+// cacheModule caches the module m.
+func (e *Environment) cacheModule(m *module) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.modules == nil {
+		e.modules = make(map[string]*module)
+	}
+	e.modules[m.t.Name] = m
+}
+
+// templateCache returns the environment's template cache, creating it if
+// necessary.
+func (e *Environment) templateCache() *templateCache {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cache == nil {
+		e.cache = newTemplateCache()
+	}
+	return e.cache
 }
 
 func (e *Environment) Parse(r io.Reader, name, filename string) (*Template, error) {
@@ -144,5 +301,6 @@ func (e *Environment) ParseString(source, name, filename string) (*Template, err
 func (e *Environment) parse(source, name, filename string) (*Tree, error) {
 	lex := e.lex(source, name, filename)
 	t := newTree(name)
+	t.env = e
 	return t.Parse(lex)
 }
@@ -0,0 +1,580 @@
+package jigo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// This file contains HTML escaping of rendered values.
+
+// Markup is a string of HTML which is safe to output as is.  When
+// autoescaping is enabled, values are HTML escaped as they are rendered,
+// unless they are Markup or implement Safe.
+type Markup string
+
+// Safe returns m.
+func (m Markup) Safe() Markup { return m }
+
+// Safe is implemented by values which know how to render themselves as safe
+// HTML.
+type Safe interface {
+	Safe() Markup
+}
+
+// asSafe returns v as Markup if it is already safe HTML.  Go's
+// template.HTML is also considered safe.
+func asSafe(v interface{}) (Markup, bool) {
+	switch v := v.(type) {
+	case Safe:
+		return v.Safe(), true
+	case template.HTML:
+		return Markup(v), true
+	}
+	return "", false
+}
+
+// escape returns v as safe HTML, escaping it unless it is already safe.
+func escape(v interface{}) Markup {
+	if m, ok := asSafe(v); ok {
+		return m
+	}
+	if v == nil {
+		return ""
+	}
+	return Markup(html.EscapeString(asString(v)))
+}
+
+// concat joins the string forms of a and b, in which nil is empty, as it is
+// when rendered.  If either of them is safe HTML, the other is escaped and the
+// result is Markup.
+func concat(a, b interface{}) interface{} {
+	_, safeA := asSafe(a)
+	_, safeB := asSafe(b)
+	if safeA || safeB {
+		return escape(a) + escape(b)
+	}
+	return filterString(a) + filterString(b)
+}
+
+// AutoEscapeExtensions returns a function for Environment.AutoEscapeFunc
+// which enables autoescaping for templates whose names end in one of the
+// given extensions, eg. AutoEscapeExtensions(".html", ".xml").
+func AutoEscapeExtensions(extensions ...string) func(name string) bool {
+	return func(name string) bool {
+		ext := path.Ext(name)
+		for _, e := range extensions {
+			if ext == e {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// This is a lightweight HTML state machine used for contextual escaping.
+// The renderer feeds it everything written to the output, so that when a
+// value is written it knows whether it is in text, in a tag, in an attribute
+// value or in the body of a <script> or <style> element, and escapes the
+// value to suit.  It does not validate HTML, and only tracks as much of it
+// as it needs to choose an escaper.
+
+// htmlState is the part of an HTML document the output is in.
+type htmlState uint8
+
+const (
+	stateText        htmlState = iota // in text
+	stateTagOpen                      // after a <
+	stateTagName                      // in a tag name
+	stateMarkup                       // after <!, which may start a comment
+	stateTag                          // in a tag, between attributes
+	stateAttrName                     // in an attribute name
+	stateAfterName                    // after an attribute name
+	stateBeforeValue                  // after an attribute's =
+	stateAttr                         // in an attribute value
+	stateScript                       // in the body of a <script> element
+	stateStyle                        // in the body of a <style> element
+	stateComment                      // in an HTML comment
+)
+
+// attrType is the kind of content an attribute value holds.
+type attrType uint8
+
+const (
+	attrText attrType = iota
+	attrURL
+	attrJS
+	attrCSS
+)
+
+// urlPart is the part of a URL attribute value the output is in.
+type urlPart uint8
+
+const (
+	urlStart urlPart = iota // at the start of the URL, before its scheme
+	urlPath                 // before any query or fragment
+	urlQuery                // in the query or fragment
+)
+
+// htmlContext tracks the state of HTML output.  It is a value type so that
+// renderers can save and restore it cheaply.
+type htmlContext struct {
+	state   htmlState
+	closing bool   // whether the tag being lexed is an end tag
+	elem    string // the name of the tag being lexed
+	attr    string // the name of the attribute being lexed
+	typ     attrType
+	delim   byte // the attribute value's quote, or 0 if it is unquoted
+	url     urlPart
+	dashes  int // the number of dashes seen, for comments
+	end     int // the length of the element's end tag matched so far
+	js      jsContext
+}
+
+// jsContext tracks the strings and comments of JavaScript or CSS.
+type jsContext struct {
+	css     bool
+	quote   byte // the open string's quote, or 0
+	comment byte // '/' in a line comment, '*' in a block comment, or 0
+	escape  bool // after a backslash in a string
+	slash   bool // after a / outside of a string or comment
+	star    bool // after a * in a block comment
+}
+
+// feed advances the context over output s.
+func (c *htmlContext) feed(s string) {
+	for i := 0; i < len(s); i++ {
+		c.next(s[i])
+	}
+}
+
+func isHTMLSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+func isASCIILetter(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// next advances the context over the byte b.
+func (c *htmlContext) next(b byte) {
+	switch c.state {
+	case stateText:
+		if b == '<' {
+			c.state = stateTagOpen
+		}
+	case stateTagOpen:
+		switch {
+		case isASCIILetter(b):
+			c.state, c.closing, c.elem = stateTagName, false, string(b)
+		case b == '/':
+			c.state, c.closing, c.elem = stateTagName, true, ""
+		case b == '!':
+			c.state, c.dashes = stateMarkup, 0
+		default:
+			c.state = stateText
+			c.next(b)
+		}
+	case stateTagName:
+		switch {
+		case b == '>':
+			c.endTag()
+		case isHTMLSpace(b) || b == '/':
+			c.state = stateTag
+		default:
+			c.elem += string(b)
+		}
+	case stateMarkup:
+		if b == '-' {
+			if c.dashes++; c.dashes == 2 {
+				c.state, c.dashes = stateComment, 0
+			}
+			return
+		}
+		// doctypes and other declarations are skipped like end tags
+		c.state, c.closing = stateTag, true
+		c.next(b)
+	case stateTag:
+		c.tag(b)
+	case stateAttrName:
+		switch {
+		case b == '=':
+			c.state = stateBeforeValue
+		case isHTMLSpace(b):
+			c.state = stateAfterName
+		case b == '>' || b == '/':
+			c.tag(b)
+		default:
+			c.attr += string(b)
+		}
+	case stateAfterName:
+		if b == '=' {
+			c.state = stateBeforeValue
+		} else if !isHTMLSpace(b) {
+			c.tag(b)
+		}
+	case stateBeforeValue:
+		switch {
+		case isHTMLSpace(b):
+		case b == '>':
+			c.endTag()
+		default:
+			c.startValue()
+			if b == '"' || b == '\'' {
+				c.delim = b
+			} else {
+				c.next(b)
+			}
+		}
+	case stateAttr:
+		switch {
+		case c.delim != 0 && b == c.delim, c.delim == 0 && isHTMLSpace(b):
+			c.state = stateTag
+		case c.delim == 0 && b == '>':
+			c.endTag()
+		case c.typ == attrURL:
+			if b == '?' || b == '#' {
+				c.url = urlQuery
+			} else if c.url == urlStart {
+				c.url = urlPath
+			}
+		case c.typ == attrJS || c.typ == attrCSS:
+			c.js.next(b)
+		}
+	case stateScript, stateStyle:
+		c.inElement(b)
+	case stateComment:
+		switch {
+		case b == '-':
+			c.dashes++
+		case b == '>' && c.dashes >= 2:
+			c.state = stateText
+		default:
+			c.dashes = 0
+		}
+	}
+}
+
+// tag advances the context over b in a tag, between attributes.
+func (c *htmlContext) tag(b byte) {
+	switch {
+	case b == '>':
+		c.endTag()
+	case isHTMLSpace(b) || b == '/':
+		c.state = stateTag
+	default:
+		c.state, c.attr = stateAttrName, string(b)
+	}
+}
+
+// startValue starts an unquoted attribute value, whose type depends on the
+// name of the attribute.
+func (c *htmlContext) startValue() {
+	c.state, c.delim, c.url = stateAttr, 0, urlStart
+	c.typ = attrTypeOf(strings.ToLower(c.attr))
+	c.js = jsContext{css: c.typ == attrCSS}
+}
+
+// endTag ends the tag being lexed.  The bodies of script and style elements
+// are JavaScript and CSS rather than HTML.
+func (c *htmlContext) endTag() {
+	c.state = stateText
+	if c.closing {
+		return
+	}
+	switch strings.ToLower(c.elem) {
+	case "script":
+		c.state, c.js = stateScript, jsContext{}
+	case "style":
+		c.state, c.js = stateStyle, jsContext{css: true}
+	}
+	c.end = 0
+}
+
+// inElement advances the context over b in the body of a script or style
+// element, which ends at the element's end tag even inside of a string.
+func (c *htmlContext) inElement(b byte) {
+	end := "</" + strings.ToLower(c.elem)
+	switch {
+	case c.end < len(end) && unicode.ToLower(rune(b)) == rune(end[c.end]):
+		c.end++
+	case c.end == len(end) && (isHTMLSpace(b) || b == '>' || b == '/'):
+		c.state, c.closing = stateTag, true
+		c.tag(b)
+		return
+	default:
+		c.end = 0
+		if b == '<' {
+			c.end = 1
+		}
+	}
+	c.js.next(b)
+}
+
+// attrTypeOf returns the type of the lowercase attribute name.
+func attrTypeOf(name string) attrType {
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return attrJS
+	case name == "style":
+		return attrCSS
+	}
+	switch name {
+	case "href", "action", "formaction", "cite", "poster", "background", "longdesc", "usemap", "codebase", "data", "manifest", "icon":
+		return attrURL
+	}
+	if strings.Contains(name, "src") || strings.Contains(name, "url") || strings.Contains(name, "uri") {
+		return attrURL
+	}
+	return attrText
+}
+
+// next advances the context over the byte b.
+func (j *jsContext) next(b byte) {
+	switch {
+	case j.escape:
+		j.escape = false
+	case j.comment == '/':
+		if b == '\n' {
+			j.comment = 0
+		}
+	case j.comment == '*':
+		if j.star && b == '/' {
+			j.comment = 0
+		}
+		j.star = b == '*'
+	case j.quote != 0:
+		if b == '\\' {
+			j.escape = true
+		} else if b == j.quote {
+			j.quote = 0
+		}
+	case j.slash && (b == '*' || b == '/' && !j.css):
+		j.slash, j.comment, j.star = false, b, false
+	default:
+		j.slash = b == '/'
+		if b == '"' || b == '\'' || b == '`' && !j.css {
+			j.quote = b
+		}
+	}
+}
+
+// filtered replaces values which are unsafe in their context.
+const filtered = "ZjigoZ"
+
+// escape returns v escaped for the context.  Safe values are only written
+// as is in text, since they were escaped for text, and attributes made by
+// xmlattr also in tags.  Elsewhere they are treated as the text they would
+// display, and escaped like any other string.
+func (c *htmlContext) escape(v interface{}) string {
+	if m, ok := asSafe(v); ok {
+		_, attrs := v.(attributes)
+		switch {
+		case c.state == stateText:
+			return string(m)
+		case attrs && (c.state == stateTagName || c.state == stateTag || c.state == stateAfterName):
+			return string(m)
+		}
+		v = html.UnescapeString(stripTags(string(m)))
+	}
+	switch c.state {
+	case stateTag, stateAttrName, stateAfterName:
+		return attrName(asString(v))
+	case stateBeforeValue:
+		// the value starts an unquoted attribute value
+		ctx := *c
+		ctx.startValue()
+		return ctx.escape(v)
+	case stateAttr:
+		var s string
+		switch c.typ {
+		case attrURL:
+			s = escapeURL(asString(v), c.url)
+		case attrJS:
+			s = escapeJS(v, c.js)
+		case attrCSS:
+			s = escapeCSS(asString(v), c.js)
+		default:
+			s = asString(v)
+		}
+		if c.delim == 0 {
+			return escapeUnquoted(s)
+		}
+		return html.EscapeString(s)
+	case stateScript:
+		return escapeJS(v, c.js)
+	case stateStyle:
+		return escapeCSS(asString(v), c.js)
+	}
+	return string(escape(v))
+}
+
+// captured is output captured by a renderer, such as the body of a set block,
+// along with the context it was captured in.  Output captured in text is
+// Markup like any other, but output captured elsewhere was escaped for that
+// context, and is only written as is once, in the same context.
+type captured struct {
+	m   Markup
+	ctx htmlContext
+}
+
+// attributes is a list of HTML attributes, which is safe in a tag as well as
+// in text.
+type attributes Markup
+
+// Safe returns a as Markup.
+func (a attributes) Safe() Markup { return Markup(a) }
+
+// stripTags returns the text of the HTML s, without its tags, comments and
+// the bodies of script and style elements.
+func stripTags(s string) string {
+	b := new(bytes.Buffer)
+	var c htmlContext
+	for i := 0; i < len(s); i++ {
+		prev := c.state
+		c.next(s[i])
+		switch {
+		case prev == stateText && c.state == stateText:
+			b.WriteByte(s[i])
+		case prev == stateTagOpen && c.state == stateText:
+			// a < which does not start a tag
+			b.WriteByte('<')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// attrName returns s if it is a harmless attribute name.
+func attrName(s string) string {
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if !isASCIILetter(b) && (i == 0 || !('0' <= b && b <= '9') && !strings.ContainsRune("-_:.", rune(b))) {
+			return filtered
+		}
+	}
+	if typ := attrTypeOf(strings.ToLower(s)); typ == attrJS || typ == attrCSS {
+		return filtered
+	}
+	return s
+}
+
+// escapeUnquoted escapes s for an unquoted attribute value, which ends at
+// whitespace as well as at quotes and tags.
+func escapeUnquoted(s string) string {
+	b := new(bytes.Buffer)
+	for _, r := range s {
+		if strings.ContainsRune(" \t\n\r\f\"'`<>=&", r) {
+			fmt.Fprintf(b, "&#%d;", r)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// safeSchemes are the URL schemes which may start a URL attribute.
+var safeSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+// escapeURL escapes s for part of a URL.  At the start of the URL, s must not
+// have a scheme other than http, https or mailto, which keeps out
+// `javascript:` URLs.  Query and fragment parts are fully percent encoded,
+// and other parts only have characters which are not allowed in URLs
+// encoded.
+func escapeURL(s string, part urlPart) string {
+	if part == urlStart {
+		if i := strings.IndexAny(s, ":/?#"); i >= 0 && s[i] == ':' && !safeSchemes[strings.ToLower(s[:i])] {
+			return "#" + filtered
+		}
+	}
+	keep := "-._~"
+	if part != urlQuery {
+		keep += "!#$%&'()*+,/:;=?@[]"
+	}
+	b := new(bytes.Buffer)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isASCIILetter(c) || '0' <= c && c <= '9' || strings.IndexByte(keep, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// escapeJS escapes v for JavaScript.  In strings it is escaped as string
+// content, in comments it is dropped, and elsewhere it is written as a JSON
+// value, so that strings are quoted and maps and slices become objects and
+// arrays.
+func escapeJS(v interface{}, j jsContext) string {
+	switch {
+	case j.comment != 0:
+		return ""
+	case j.quote != 0:
+		return escapeJSString(asString(v))
+	case v == nil || isUndefined(v):
+		return "null"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(asString(v))
+	}
+	// json escapes <, > and & already
+	return string(b)
+}
+
+// escapeJSString escapes s for the content of a JavaScript string, which may
+// be quoted with ', " or `.
+func escapeJSString(s string) string {
+	b := new(bytes.Buffer)
+	for _, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\'', '"', '`', '<', '>', '&', '$', '\u2028', '\u2029':
+			fmt.Fprintf(b, `\u%04X`, r)
+		default:
+			if r < ' ' {
+				fmt.Fprintf(b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
+
+// escapeCSS escapes s for CSS.  In strings, characters other than letters
+// and digits are escaped, and elsewhere s must be a simple value like a
+// color, length or keyword.
+func escapeCSS(s string, j jsContext) string {
+	if j.quote != 0 {
+		b := new(bytes.Buffer)
+		for _, r := range s {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				b.WriteRune(r)
+			} else {
+				fmt.Fprintf(b, `\%X `, r)
+			}
+		}
+		return b.String()
+	}
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" #.,%-_", r) {
+			return filtered
+		}
+	}
+	return s
+}
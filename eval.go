@@ -2,9 +2,15 @@ package jigo
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"reflect"
+	"strings"
+	"time"
 )
 
 // This file contains ast evaluation.
@@ -14,30 +20,466 @@ import (
 // to also be used for other purposes such as prettifying or codegen.
 
 type renderer struct {
-	t *Template
+	t *Template // the template whose nodes are being rendered
 	c contextStack
-	b bytes.Buffer
+	w io.Writer // the output
+	// blocks maps block names to their definitions, ordered from the most
+	// derived template to the base template.
+	blocks map[string][]blockRef
+	// includes is the chain of templates which included or imported this
+	// one, ending with the template being rendered, and is used to detect
+	// import cycles.  Includes may recurse, eg. to render a tree, and are
+	// limited only by the depth.
+	includes []string
+	// autoescape is whether rendered values are HTML escaped.
+	autoescape bool
+	// html is the state of the output HTML, which is tracked when the
+	// environment uses contextual escaping.
+	html htmlContext
+	// run is the state of the render this renderer is part of.
+	run *run
+	// depth is the number of macro calls and includes being rendered.
+	depth int
 }
 
-func newRenderer(t *Template) *renderer {
-	return &renderer{t: t}
+// run is the state shared by all of the renderers of a single render, which
+// is used to enforce cancellation and the environment's limits.
+type run struct {
+	ctx        context.Context
+	deadline   time.Time // zero if the environment has no Timeout
+	iterations int64
+	// escaped is output captured outside of HTML text which has not yet
+	// been written.  Entries are deleted as they are written, so that they
+	// do not pile up in loops.
+	escaped map[captured]bool
 }
 
-func (r *renderer) render(c contextStack) (string, error) {
+func newRun(ctx context.Context, env *Environment) *run {
+	r := &run{ctx: ctx, escaped: make(map[captured]bool)}
+	if env.Timeout > 0 {
+		r.deadline = time.Now().Add(env.Timeout)
+	}
+	return r
+}
+
+// check returns an error if the render has been cancelled or has taken too
+// long.
+func (r *renderer) check() error {
+	if err := r.run.ctx.Err(); err != nil {
+		return err
+	}
+	if !r.run.deadline.IsZero() && time.Now().After(r.run.deadline) {
+		return &LimitError{"Timeout", r.t.env.Timeout}
+	}
+	return nil
+}
+
+// iterate counts a loop iteration, and returns an error if the render
+// should stop.
+func (r *renderer) iterate() error {
+	r.run.iterations++
+	if max := r.t.env.MaxIterations; max > 0 && r.run.iterations > max {
+		return &LimitError{"MaxIterations", max}
+	}
+	return r.check()
+}
+
+// maxDepth is the depth of nested macro calls and includes beyond which no
+// render may go, whatever its environment's MaxDepth.
+const maxDepth = 1000
+
+// descend returns the depth of a macro call or include rendered by r, or an
+// error if the render should stop.
+func (r *renderer) descend() (int, error) {
+	max := r.t.env.MaxDepth
+	if max <= 0 || max > maxDepth {
+		max = maxDepth
+	}
+	if r.depth >= max {
+		return 0, &LimitError{"MaxDepth", max}
+	}
+	return r.depth + 1, r.check()
+}
+
+// isAbort returns whether err stops a render, in which case it is returned
+// as is rather than annotated with where in the template it happened.  A
+// *SecurityError is already located where it happened.
+func isAbort(err error) bool {
+	switch err.(type) {
+	case *LimitError, *SecurityError:
+		return true
+	}
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// limitWriter is a writer which fails once more than max bytes have been
+// written to it.
+type limitWriter struct {
+	w   io.Writer
+	n   int64
+	max int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.n += int64(len(p)); l.n > l.max {
+		return 0, &LimitError{"MaxOutput", l.max}
+	}
+	return l.w.Write(p)
+}
+
+// blockRef is a block and the template which defined it.
+type blockRef struct {
+	t     *Template
+	block *BlockNode
+}
+
+func newRenderer(t *Template, w io.Writer) *renderer {
+	return &renderer{
+		t:          t,
+		w:          w,
+		blocks:     make(map[string][]blockRef),
+		includes:   []string{t.Name},
+		autoescape: t.env.autoescape(t.Name),
+	}
+}
+
+func (r *renderer) render(c contextStack) error {
 	r.c = c
-	err := r.renderList(r.t.base.Root)
-	return r.b.String(), err
+	// top level assignments are made in a scope of their own
+	r.c.push(newScope())
+	return r.renderTemplate(r.t)
+}
+
+// renderTemplate renders t.  If t extends another template, the chain of
+// parents is followed and the base template is rendered using the blocks of
+// its children.
+func (r *renderer) renderTemplate(t *Template) error {
+	// extends is the chain of templates rendered so far, which is used to
+	// detect extends cycles
+	var extends []string
+	for t != nil {
+		if err := r.check(); err != nil {
+			return err
+		}
+		r.t = t
+		extends = append(extends, t.Name)
+		for name, block := range t.base.Blocks {
+			r.blocks[name] = append(r.blocks[name], blockRef{t, block})
+		}
+		var err error
+		if t, err = r.renderRoot(t.base.Root, extends); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderRoot renders the top level of a template and returns its parent
+// template, if it has one.  Once a template has extended a parent, its top
+// level output is discarded, since the parent template is rendered instead,
+// but its top level assignments, macro definitions and imports are still made.
+// The parent may not be one of the templates in extends, which have already
+// been rendered.
+func (r *renderer) renderRoot(root *ListNode, extends []string) (*Template, error) {
+	var parent *Template
+	for _, node := range root.Nodes {
+		if n, ok := node.(*ExtendsNode); ok {
+			if parent != nil {
+				return nil, r.errorf(n, "template extends more than one template")
+			}
+			var err error
+			if parent, err = r.loadTemplate(n.Template); err != nil {
+				return nil, err
+			}
+			for _, name := range extends {
+				if name == parent.Name {
+					return nil, r.errorf(n.Template, "extends cycle: %s -> %s", strings.Join(extends, " -> "), parent.Name)
+				}
+			}
+			continue
+		}
+		if parent != nil {
+			switch node.(type) {
+			case *SetNode, *MacroNode, *ImportNode, *FromNode:
+			default:
+				continue
+			}
+		}
+		if err := r.renderNode(node); err != nil {
+			return nil, err
+		}
+	}
+	return parent, nil
+}
+
+// loadTemplate evaluates n and loads the template it names from the
+// environment.  n may also evaluate to a template.
+func (r *renderer) loadTemplate(n Node) (*Template, error) {
+	name, err := r.eval(n)
+	if err != nil {
+		return nil, err
+	}
+	switch name := name.(type) {
+	case *Template:
+		return name, nil
+	case string:
+		t, err := r.t.env.Load(name)
+		if err != nil {
+			return nil, r.errorf(n, "%s", err)
+		}
+		return t, nil
+	}
+	return nil, r.errorf(n, "cannot load template from %T", name)
+}
+
+// renderInclude renders an included template into the output.
+func (r *renderer) renderInclude(n *IncludeNode) error {
+	t, names, err := r.selectTemplate(n.Template)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		switch {
+		case n.IgnoreMissing:
+			return nil
+		case len(names) == 1:
+			return r.errorf(n, "%s", &NotFoundError{names[0]})
+		}
+		return r.errorf(n, "none of the templates %s were found", strings.Join(names, ", "))
+	}
+	sub, err := r.subRenderer(n, t, n.WithContext)
+	if err != nil {
+		return err
+	}
+	sub.html = r.html
+	err = sub.renderTemplate(t)
+	r.html = sub.html
+	return err
+}
+
+// subRenderer returns a renderer for the template t, which is included or
+// imported at n.  With context, t sees the variables visible at n, and
+// without it, only the environment's globals.  Assignments made by t are
+// made in a new scope.
+func (r *renderer) subRenderer(n Node, t *Template, withContext bool) (*renderer, error) {
+	depth, err := r.descend()
+	if err != nil {
+		return nil, err
+	}
+	sub := newRenderer(t, r.w)
+	sub.run, sub.depth = r.run, depth
+	sub.includes = append(r.includes[:len(r.includes):len(r.includes)], t.Name)
+	if withContext {
+		sub.c = append(contextStack(nil), r.c...)
+	} else {
+		sub.c = NewContextStack(r.t.env.Globals)
+	}
+	sub.c.push(newScope())
+	return sub, nil
+}
+
+// importModule loads the template named by n and executes it to create a
+// module.  Modules imported without context are cached by the environment,
+// so each is only executed once.
+func (r *renderer) importModule(n Node, withContext bool) (*module, error) {
+	t, err := r.loadTemplate(n)
+	if err != nil {
+		return nil, err
+	}
+	env := r.t.env
+	if !withContext {
+		if m, ok := env.cachedModule(t); ok {
+			return m, nil
+		}
+	}
+	for _, name := range r.includes {
+		if name == t.Name {
+			return nil, r.errorf(n, "import cycle: %s -> %s", strings.Join(r.includes, " -> "), t.Name)
+		}
+	}
+	sub, err := r.subRenderer(n, t, withContext)
+	if err != nil {
+		return nil, err
+	}
+	scope := sub.c[len(sub.c)-1]
+	// output of the module template is discarded
+	sub.w = ioutil.Discard
+	if err := sub.renderTemplate(t); err != nil {
+		return nil, err
+	}
+	m := &module{t: t, attrs: make(map[string]interface{})}
+	for k, v := range scope.ctx.(map[string]interface{}) {
+		if !strings.HasPrefix(k, "_") {
+			m.attrs[k] = v
+		}
+	}
+	if !withContext {
+		env.cacheModule(m)
+	}
+	return m, nil
+}
+
+// renderFrom imports names from a module into the current scope.
+func (r *renderer) renderFrom(n *FromNode) error {
+	m, err := r.importModule(n.Module, n.WithContext)
+	if err != nil {
+		return err
+	}
+	for _, imp := range n.Imports {
+		v, ok := m.attrs[imp.Name]
+		if !ok {
+			return r.errorf(n, "%s does not export %s", m.t.Name, imp.Name)
+		}
+		r.c.set(imp.As, v)
+	}
+	return nil
+}
+
+// selectTemplate evaluates n, which may be a template, a template name, or a
+// list of them, and returns the first template which exists.  If none of
+// them exist, the template is nil and the names which were tried are
+// returned.
+func (r *renderer) selectTemplate(n Node) (*Template, []string, error) {
+	v, err := r.eval(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates := []interface{}{v}
+	switch v.(type) {
+	case string, *Template:
+	default:
+		if candidates, err = iterate(v); err != nil {
+			return nil, nil, r.errorf(n, "cannot load template from %T", v)
+		}
+	}
+	var names []string
+	for _, c := range candidates {
+		switch c := c.(type) {
+		case *Template:
+			return c, nil, nil
+		case string:
+			t, err := r.t.env.Load(c)
+			if err == nil {
+				return t, nil, nil
+			}
+			if !IsNotFound(err) {
+				return nil, nil, r.errorf(n, "%s", err)
+			}
+			names = append(names, c)
+		default:
+			return nil, nil, r.errorf(n, "cannot load template from %T", c)
+		}
+	}
+	return nil, names, nil
+}
+
+// capture renders with fn and returns its output as a string rather than
+// writing it to the output.
+func (r *renderer) capture(fn func() error) (interface{}, error) {
+	// captured output is usually written where it is captured, so it is
+	// rendered in the current HTML context, which is restored afterwards
+	b, bw := r.buffer()
+	w, html := r.w, r.html
+	r.w = bw
+	defer func() { r.w, r.html = w, html }()
+	err := fn()
+	out := r.output(b.String())
+	if m, ok := out.(Markup); ok && r.t.env.ContextualEscape && html.state != stateText {
+		r.run.escaped[captured{m, html}] = true
+	}
+	return out, err
+}
+
+// buffer returns a buffer for output which is captured rather than written,
+// and a writer for it.  Like the output, the writer fails once more than
+// MaxOutput bytes have been written to it.
+func (r *renderer) buffer() (*bytes.Buffer, io.Writer) {
+	b := new(bytes.Buffer)
+	if max := r.t.env.MaxOutput; max > 0 {
+		return b, &limitWriter{w: b, max: max}
+	}
+	return b, b
+}
+
+// output returns rendered output s, which is Markup if autoescaping is on,
+// since any values in it have already been escaped.
+func (r *renderer) output(s string) interface{} {
+	if r.autoescape {
+		return Markup(s)
+	}
+	return s
+}
+
+// write writes the string form of v to the output, escaping it if
+// autoescaping is on.  nil values are not written.
+func (r *renderer) write(v interface{}) error {
+	var s string
+	switch {
+	case v == nil:
+		return nil
+	case r.autoescape && r.t.env.ContextualEscape:
+		if m, ok := v.(Markup); ok && r.run.escaped[captured{m, r.html}] {
+			delete(r.run.escaped, captured{m, r.html})
+			s = string(m)
+		} else {
+			s = r.html.escape(v)
+		}
+	case r.autoescape:
+		s = string(escape(v))
+	default:
+		s = asString(v)
+	}
+	return r.writeString(s)
+}
+
+// writeString writes s to the output as is.  Errors writing to the output
+// are returned as is, and abort rendering.
+func (r *renderer) writeString(s string) error {
+	if _, err := io.WriteString(r.w, s); err != nil {
+		return err
+	}
+	if r.t.env.ContextualEscape {
+		r.html.feed(s)
+	}
+	return nil
 }
 
 func (r *renderer) renderNode(n Node) error {
 	switch t := n.(type) {
 	case *TextNode:
-		_, err := r.b.Write(t.Text)
-		return err
+		return r.writeString(string(t.Text))
 	case *VarNode:
 		return r.renderVar(t)
 	case *IfBlockNode:
 		return r.renderCond(t)
+	case *ForNode:
+		return r.renderFor(t)
+	case *BlockNode:
+		return r.renderBlock(t, r.blocks[t.Name])
+	case *FilterBlockNode:
+		return r.renderFilterBlock(t)
+	case *SetNode:
+		return r.renderSet(t)
+	case *MacroNode:
+		m := r.newMacro(t.Name, t.Params, t.Defaults, t.Body)
+		m.varargs, m.kwargs = t.Varargs, t.Kwargs
+		r.c.set(t.Name, m)
+		return nil
+	case *CallNode:
+		return r.renderCallBlock(t)
+	case *IncludeNode:
+		return r.renderInclude(t)
+	case *ImportNode:
+		mod, err := r.importModule(t.Module, t.WithContext)
+		if err != nil {
+			return err
+		}
+		r.c.set(t.As, mod)
+		return nil
+	case *FromNode:
+		return r.renderFrom(t)
+	case *AutoescapeNode:
+		return r.renderAutoescape(t)
 	case *ListNode:
 		return r.renderList(t)
 	default:
@@ -56,36 +498,41 @@ func (r *renderer) renderList(n *ListNode) error {
 	return nil
 }
 
+// errorf returns an error annotated with the location of n in the template.
+func (r *renderer) errorf(n Node, format string, args ...interface{}) error {
+	location, _ := r.t.base.ErrorContext(n)
+	return fmt.Errorf("template: %s: %s", location, fmt.Sprintf(format, args...))
+}
+
 func (r *renderer) renderVar(n *VarNode) error {
-	switch t := n.Node.(type) {
-	case *LookupNode:
-		return r.renderLookup(t)
-	case *AddExpr:
-		i, err := eval(t, r.c)
-		if err != nil {
-			return err
+	v, err := r.eval(n.Node)
+	if err != nil {
+		return err
+	}
+	if u, ok := v.(undefined); ok {
+		switch r.t.env.Undefined {
+		case StrictUndefined:
+			return r.errorf(n.Node, "%s is undefined", u.name)
+		case DebugUndefined:
+			return r.writeString("{{ " + u.name + " }}")
 		}
-		// evaluated expressions are coerced to string with Sprint before rendering
-		r.b.WriteString(fmt.Sprint(i))
 		return nil
-	default:
-		return fmt.Errorf("Unknown node type %v", t.Type())
 	}
-	return nil
+	if err := r.t.env.printable(false, v); err != nil {
+		return r.denied(n.Node, err.(*SecurityError))
+	}
+	// evaluated expressions are coerced to string with Sprint before rendering
+	return r.write(v)
 }
 
 // renderCond renders evaluates and renders conditional block tags
 func (r *renderer) renderCond(n *IfBlockNode) error {
 	for _, cond := range n.Conditionals {
 		c := cond.(*ConditionalNode)
-		g, err := eval(c.Guard, r.c)
+		val, err := r.evalBool(c.Guard)
 		if err != nil {
 			return err
 		}
-		val, err := asBool(g)
-		if err != nil {
-			return fmt.Errorf(`Non-boolean "%s" used in boolean context.`, g)
-		}
 		if val {
 			return r.renderNode(c.Body)
 		}
@@ -97,25 +544,403 @@ func (r *renderer) renderCond(n *IfBlockNode) error {
 	return nil
 }
 
-func (r *renderer) renderLookup(n *LookupNode) error {
-	// FIXME: strict mode where lookup failures are runtime errors?
-	v, ok := r.c.lookup(n.Name)
-	if ok {
-		r.b.WriteString(fmt.Sprint(v.Interface()))
+// renderFor renders the body of a for loop once for each item in its
+// iterable, or its else clause if there are no items.
+func (r *renderer) renderFor(n *ForNode) error {
+	val, err := r.eval(n.InExpr)
+	if err != nil {
+		return err
+	}
+	if err := r.use(n.InExpr, val); err != nil {
+		return err
+	}
+	next, length, err := r.loopItems(n, val)
+	if err != nil {
+		return err
+	}
+
+	loop := newLoopContext(next, length)
+	if more, err := loop.peek(); err != nil {
+		return err
+	} else if !more {
+		if n.Else != nil {
+			return r.renderNode(n.Else)
+		}
+		return nil
+	}
+	scope := newScope()
+	r.c.push(scope)
+	defer r.c.pop()
+	scope.set("loop", loop)
+
+	for {
+		more, err := loop.advance()
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+		if err := r.iterate(); err != nil {
+			return err
+		}
+		if err := r.assign(n.ForExpr, loop.item); err != nil {
+			return err
+		}
+		if err := r.renderNode(n.Body); err != nil {
+			return err
+		}
+		if loop.err != nil {
+			return loop.err
+		}
 	}
 	return nil
 }
 
-// main ltr eval
-func eval(n Node, c contextStack) (interface{}, error) {
-	switch t := n.(type) {
+// loopItems returns a function which yields the items of val for the for
+// loop n one at a time, and the number of items, or -1 if that is not known
+// in advance.  Channels are received from as the loop runs, and other
+// iterables are iterated up front.
+func (r *renderer) loopItems(n *ForNode, val interface{}) (func() (interface{}, bool, error), int, error) {
+	v := reflect.ValueOf(val)
+	if v.Kind() == reflect.Chan && v.Type().ChanDir()&reflect.RecvDir != 0 {
+		return func() (interface{}, bool, error) { return r.recv(v) }, -1, nil
+	}
+	items, err := iterate(val)
+	if err != nil {
+		return nil, 0, r.errorf(n.InExpr, "%s", err)
+	}
+	// maps unpacked into multiple targets iterate over (key, value) pairs
+	_, unpacking := n.ForExpr.(*TupleNode)
+	if unpacking && v.Kind() == reflect.Map {
+		for i, k := range items {
+			items[i] = []interface{}{k, v.MapIndex(reflect.ValueOf(k)).Interface()}
+		}
+	}
+	i := 0
+	return func() (interface{}, bool, error) {
+		if i == len(items) {
+			return nil, false, nil
+		}
+		i++
+		return items[i-1], true, nil
+	}, len(items), nil
+}
+
+// recv receives an item from the channel ch, and returns false once ch is
+// closed.  It stops waiting if the render is cancelled or times out.
+func (r *renderer) recv(ch reflect.Value) (interface{}, bool, error) {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(r.run.ctx.Done())},
+	}
+	if !r.run.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(r.run.deadline))
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	}
+	switch i, x, ok := reflect.Select(cases); i {
+	case 0:
+		if !ok {
+			return nil, false, nil
+		}
+		return x.Interface(), true, nil
+	case 1:
+		return nil, false, r.run.ctx.Err()
+	}
+	return nil, false, &LimitError{"Timeout", r.t.env.Timeout}
+}
+
+// renderSet renders an assignment.
+func (r *renderer) renderSet(n *SetNode) error {
+	if n.Body == nil {
+		val, err := r.eval(n.Value)
+		if err != nil {
+			return err
+		}
+		if err := r.use(n.Value, val); err != nil {
+			return err
+		}
+		return r.assign(n.Target, val)
+	}
+	body, err := r.capture(func() error { return r.renderNode(n.Body) })
+	if err != nil {
+		return err
+	}
+	val := body
+	for _, f := range n.Filters {
+		if val, err = r.applyFilter(f, val); err != nil {
+			return err
+		}
+	}
+	return r.assign(n.Target, val)
+}
+
+// assign sets target to val in the innermost scope.  Tuple targets unpack
+// val into each of their names, and attribute targets set an attribute on a
+// namespace.
+func (r *renderer) assign(target Node, val interface{}) error {
+	switch t := target.(type) {
 	case *LookupNode:
-		// we ignore lookup errors here and return nil
-		val, ok := c.lookup(t.Name)
+		r.c.set(t.Name, val)
+	case *TupleNode:
+		vals, err := unpack(val, t.len())
+		if err != nil {
+			return r.errorf(t, "%s", err)
+		}
+		for i, n := range t.Nodes {
+			if err := r.assign(n, vals[i]); err != nil {
+				return err
+			}
+		}
+	case *AttrExpr:
+		v, err := r.eval(t.Value)
+		if err != nil {
+			return err
+		}
+		ns, ok := v.(*namespace)
 		if !ok {
-			return nil, nil
+			return r.errorf(t, "cannot assign attribute %s of %s, which is not a namespace", t.Name, t.Value)
 		}
-		return val.Interface(), nil
+		ns.attrs[t.Name] = val
+	default:
+		return r.errorf(target, "cannot assign to %s", target)
+	}
+	return nil
+}
+
+// macro is a macro defined by a template, or the body of a call block.
+// When called, it renders body with its arguments bound to params, and
+// returns the output.  Parameters which are not passed take their default
+// values, or are undefined if they have none.  Extra positional and keyword
+// arguments are available as `varargs` and `kwargs`, and are an error if the
+// body does not use them.  The body of a call block is available as
+// `caller`.  The body sees the scopes in which the macro was defined rather
+// than those of its caller.
+type macro struct {
+	name     string
+	params   []string
+	defaults []Node
+	body     *ListNode
+	varargs  bool // whether extra positional arguments are accepted
+	kwargs   bool // whether extra keyword arguments are accepted
+	// def is the renderer which defined the macro.  Macros render with their
+	// own copy of it, since macros imported from a cached module may be
+	// called by several renders at once.
+	def renderer
+}
+
+func (r *renderer) newMacro(name string, params []string, defaults []Node, body *ListNode) *macro {
+	m := &macro{name: name, params: params, defaults: defaults, body: body, def: *r}
+	m.def.c = append(contextStack(nil), r.c...)
+	return m
+}
+
+func (m *macro) String() string { return "<macro " + m.name + ">" }
+
+// call calls the macro from the renderer caller, whose render it is part of.
+func (m *macro) call(caller *renderer, args Args, kwargs Kwargs) (interface{}, error) {
+	depth, err := caller.descend()
+	if err != nil {
+		return nil, err
+	}
+	r := m.def
+	r.run, r.depth = caller.run, depth
+	// macros are called from expressions, so their output starts in HTML text
+	b, bw := r.buffer()
+	r.w, r.html = bw, htmlContext{}
+	scope := newScope()
+	r.c = append(m.def.c[:len(m.def.c):len(m.def.c)], scope)
+
+	first := len(m.params) - len(m.defaults)
+	for i, p := range m.params {
+		v, ok := kwargs[p]
+		switch {
+		case i < len(args):
+			if ok {
+				return nil, fmt.Errorf("macro %s got multiple values for argument %s", m.name, p)
+			}
+			v = args[i]
+		case ok:
+		case i >= first:
+			// defaults are evaluated in the macro's scope, so they may refer
+			// to earlier parameters
+			if v, err = r.eval(m.defaults[i-first]); err != nil {
+				return nil, err
+			}
+		default:
+			v = undefined{p}
+		}
+		scope.set(p, v)
+	}
+
+	varargs := []interface{}{}
+	if len(args) > len(m.params) {
+		if !m.varargs {
+			return nil, fmt.Errorf("macro %s takes at most %d arguments, got %d", m.name, len(m.params), len(args))
+		}
+		varargs = args[len(m.params):]
+	}
+	extra := map[string]interface{}{}
+	for k, v := range kwargs {
+		if _, ok := scope.lookup(k); ok {
+			continue
+		}
+		switch {
+		case k == "caller":
+			scope.set(k, v)
+		case !m.kwargs:
+			return nil, fmt.Errorf("macro %s got an unexpected keyword argument %s", m.name, k)
+		default:
+			extra[k] = v
+		}
+	}
+	scope.set("varargs", varargs)
+	scope.set("kwargs", extra)
+	err = r.renderNode(m.body)
+	return r.output(b.String()), err
+}
+
+// callable returns whether fn can be called from a template.
+func callable(fn interface{}) bool {
+	switch fn.(type) {
+	case *macro, method, builtin:
+		return true
+	}
+	return fn != nil && reflect.TypeOf(fn).Kind() == reflect.Func
+}
+
+// call calls fn, which is a macro, a method or a Go function, from n.
+func (r *renderer) call(n Node, fn interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	if err := r.t.env.allowCall(fn); err != nil {
+		return nil, r.denied(n, err.(*SecurityError))
+	}
+	switch fn := fn.(type) {
+	case *macro:
+		return fn.call(r, args, kwargs)
+	case method:
+		return callFunc(fn.fn.Interface(), args, kwargs)
+	case builtin:
+		return callFunc(fn.fn, args, kwargs)
+	}
+	return callFunc(fn, args, kwargs)
+}
+
+// renderCallBlock renders a call block, which calls a macro with the block's
+// body passed as `caller`.
+func (r *renderer) renderCallBlock(n *CallNode) error {
+	fn, err := r.eval(n.Call.Func)
+	if err != nil {
+		return err
+	}
+	if !callable(fn) {
+		return r.errorf(n.Call, "%s is not callable", n.Call.Func)
+	}
+	args, kwargs, err := r.evalArgs(n.Call.Args, n.Call.Kwargs)
+	if err != nil {
+		return err
+	}
+	if kwargs == nil {
+		kwargs = make(map[string]interface{})
+	}
+	caller := r.newMacro("caller", n.Params, n.Defaults, n.Body)
+	caller.varargs, caller.kwargs = n.Varargs, n.Kwargs
+	kwargs["caller"] = caller
+	v, err := r.call(n.Call, fn, args, kwargs)
+	if isAbort(err) {
+		return err
+	} else if err != nil {
+		return r.errorf(n.Call, "%s: %s", n.Call.Func, err)
+	}
+	return r.write(v)
+}
+
+// renderAutoescape renders the body of an autoescape block with autoescaping
+// turned on or off.
+func (r *renderer) renderAutoescape(n *AutoescapeNode) error {
+	enabled, err := r.evalBool(n.Enabled)
+	if err != nil {
+		return err
+	}
+	autoescape := r.autoescape
+	r.autoescape = enabled
+	defer func() { r.autoescape = autoescape }()
+	return r.renderNode(n.Body)
+}
+
+// renderBlock renders the most derived definition of a block in the chain
+// of definitions refs.  Within the block, `super()` renders the next block
+// up the chain.
+func (r *renderer) renderBlock(n *BlockNode, refs []blockRef) error {
+	if len(refs) == 0 {
+		return r.renderNode(n.Body)
+	}
+	t := r.t
+	r.t = refs[0].t
+	defer func() { r.t = t }()
+
+	scope := newScope()
+	scope.set("super", builtin{func(...interface{}) (interface{}, error) {
+		if len(refs) < 2 {
+			return nil, r.errorf(n, "block %q has no parent block", n.Name)
+		}
+		return r.capture(func() error { return r.renderBlock(refs[1].block, refs[1:]) })
+	}})
+	r.c.push(scope)
+	defer r.c.pop()
+	return r.renderNode(refs[0].block.Body)
+}
+
+// applyTest evaluates the test expression t.
+func (r *renderer) applyTest(t *TestExpr) (interface{}, error) {
+	val, err := r.eval(t.Value)
+	if err != nil {
+		return nil, err
+	}
+	args, kwargs, err := r.evalArgs(t.Args, t.Kwargs)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := r.t.env.test(t.Name, val, args, kwargs)
+	if err != nil {
+		return nil, r.errorf(t, "%s", err)
+	}
+	return ok != t.Negated, nil
+}
+
+// renderFilterBlock renders the body of a filter block and writes it out
+// after passing it through each of the block's filters in turn.
+func (r *renderer) renderFilterBlock(n *FilterBlockNode) error {
+	body, err := r.capture(func() error { return r.renderNode(n.Body) })
+	if err != nil {
+		return err
+	}
+	val := body
+	for _, f := range n.Filters {
+		if val, err = r.applyFilter(f, val); err != nil {
+			return err
+		}
+	}
+	return r.write(val)
+}
+
+// lookup returns the value of the name n, or undefined if it is not defined.
+func (r *renderer) lookup(n *LookupNode) (interface{}, error) {
+	val, ok, err := r.c.find(n.Name)
+	if err != nil {
+		return nil, r.denied(n, err.(*SecurityError))
+	}
+	if !ok {
+		return undefined{n.Name}, nil
+	}
+	return val.Interface(), nil
+}
+
+// main ltr eval
+func (r *renderer) eval(n Node) (interface{}, error) {
+	switch t := n.(type) {
+	case *LookupNode:
+		return r.lookup(t)
 	case *FloatNode:
 		return t.Value, nil
 	case *IntegerNode:
@@ -124,20 +949,609 @@ func eval(n Node, c contextStack) (interface{}, error) {
 		return t.Value, nil
 	case *BoolNode:
 		return t.Value, nil
+	case *NoneNode:
+		return nil, nil
+	case *ListNode:
+		return r.evalList(t.Nodes)
+	case *TupleNode:
+		return r.evalList(t.Nodes)
+	case *MapExpr:
+		m := make(map[string]interface{}, len(t.Elems))
+		for _, elem := range t.Elems {
+			key, err := r.eval(elem.Key)
+			if err != nil {
+				return nil, err
+			}
+			val, err := r.eval(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			if err := r.t.env.printable(false, key); err != nil {
+				return nil, r.denied(elem.Key, err.(*SecurityError))
+			}
+			m[asString(key)] = val
+		}
+		return m, nil
+	case *AttrExpr:
+		val, err := r.eval(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		if u, ok := val.(undefined); ok {
+			return r.chain(t, u)
+		}
+		attr, ok, err := getattr(val, t.Name, r.t.env.Sandbox)
+		if err != nil {
+			return nil, r.denied(t, err.(*SecurityError))
+		}
+		if !ok {
+			return undefined{t.String()}, nil
+		}
+		return attr, nil
+	case *IndexExpr:
+		val, err := r.eval(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		if u, ok := val.(undefined); ok {
+			return r.chain(t, u)
+		}
+		key, err := r.eval(t.Index)
+		if err != nil {
+			return nil, err
+		}
+		v, err := index(val, key, r.t.env.Sandbox)
+		if se, ok := err.(*SecurityError); ok {
+			return nil, r.denied(t, se)
+		} else if err != nil {
+			return r.missing(t, err)
+		}
+		return v, nil
+	case *SliceExpr:
+		val, err := r.eval(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		if u, ok := val.(undefined); ok {
+			return r.chain(t, u)
+		}
+		var bounds [3]interface{}
+		for i, n := range []Node{t.Start, t.Stop, t.Step} {
+			if n == nil {
+				continue
+			}
+			if bounds[i], err = r.eval(n); err != nil {
+				return nil, err
+			}
+		}
+		v, err := slice(val, bounds[0], bounds[1], bounds[2])
+		if err != nil {
+			return r.missing(t, err)
+		}
+		return v, nil
+	case *CallExpr:
+		fn, err := r.eval(t.Func)
+		if err != nil {
+			return nil, err
+		}
+		if !callable(fn) {
+			return nil, r.errorf(t, "%s is not callable", t.Func)
+		}
+		args, kwargs, err := r.evalArgs(t.Args, t.Kwargs)
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.call(t, fn, args, kwargs)
+		if isAbort(err) {
+			return nil, err
+		} else if err != nil {
+			return nil, r.errorf(t, "%s: %s", t.Func, err)
+		}
+		return v, nil
 	case *AddExpr:
-		lhs, err := eval(t.lhs, c)
+		lhs, err := r.eval(t.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := r.eval(t.rhs)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.defined(t, lhs, rhs); err != nil {
+			return nil, err
+		}
+		v, err := evalAdd(lhs, rhs, t.operator)
+		if err != nil {
+			return nil, r.errorf(t, "%s", err)
+		}
+		return v, nil
+	case *MulExpr:
+		lhs, err := r.eval(t.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := r.eval(t.rhs)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.defined(t, lhs, rhs); err != nil {
+			return nil, err
+		}
+		v, err := evalAdd(lhs, rhs, t.operator)
+		if err != nil {
+			return nil, r.errorf(t, "%s", err)
+		}
+		return v, nil
+	case *ConcatExpr:
+		lhs, err := r.eval(t.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := r.eval(t.rhs)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.use(t, lhs, rhs); err != nil {
+			return nil, err
+		}
+		if err := r.t.env.printable(false, lhs, rhs); err != nil {
+			return nil, r.denied(t, err.(*SecurityError))
+		}
+		return concat(lhs, rhs), nil
+	case *FilterExpr:
+		val, err := r.eval(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		return r.applyFilter(t, val)
+	case *TestExpr:
+		return r.applyTest(t)
+	case *CompareExpr:
+		return r.evalCompare(t)
+	case *LogicalExpr:
+		lhs, err := r.evalBool(t.lhs)
 		if err != nil {
 			return nil, err
 		}
-		rhs, err := eval(t.rhs, c)
+		// short-circuit if the lhs decides the result
+		if lhs == (t.operator.val == "or" || t.operator.val == "||") {
+			return lhs, nil
+		}
+		return r.evalBool(t.rhs)
+	case *UnaryNode:
+		if t.Unary.typ == tokenNot {
+			val, err := r.evalBool(t.Value)
+			return !val, err
+		}
+		val, err := r.eval(t.Value)
 		if err != nil {
 			return nil, err
 		}
-		return evalAdd(lhs, rhs, t.operator)
+		if err := r.defined(t, val); err != nil {
+			return nil, err
+		}
+		v, err := evalUnary(val, t.Unary)
+		if err != nil {
+			return nil, r.errorf(t, "%s", err)
+		}
+		return v, nil
 	}
 	return nil, nil
 }
 
+// evalList evaluates the elements of a list or tuple literal.
+func (r *renderer) evalList(nodes []Node) ([]interface{}, error) {
+	list := make([]interface{}, len(nodes))
+	for i, n := range nodes {
+		v, err := r.eval(n)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+// missing handles an error from evaluating the subscript n.  Missing keys
+// and out of range indices evaluate to undefined unless undefined values are
+// strict, and other errors are returned with the position of n.
+func (r *renderer) missing(n Node, err error) (interface{}, error) {
+	if _, ok := err.(missingError); ok && r.t.env.Undefined != StrictUndefined {
+		return undefined{n.String()}, nil
+	}
+	return nil, r.errorf(n, "%s", err)
+}
+
+// defined returns an error located at n if any of vals is undefined.
+func (r *renderer) defined(n Node, vals ...interface{}) error {
+	for _, v := range vals {
+		if u, ok := v.(undefined); ok {
+			return r.errorf(n, "%s is undefined", u.name)
+		}
+	}
+	return nil
+}
+
+// use returns an error located at n if any of vals is undefined and
+// undefined values are strict.
+func (r *renderer) use(n Node, vals ...interface{}) error {
+	if r.t.env.Undefined != StrictUndefined {
+		return nil
+	}
+	return r.defined(n, vals...)
+}
+
+// chain returns the attribute or item n of the undefined value u, which is
+// undefined if undefined values are chainable and an error otherwise.
+func (r *renderer) chain(n Node, u undefined) (interface{}, error) {
+	if r.t.env.Undefined == ChainableUndefined {
+		return undefined{n.String()}, nil
+	}
+	return nil, r.errorf(n, "%s is undefined", u.name)
+}
+
+// evalBool evaluates n as a condition, which must be a boolean.  Undefined
+// values are false, or an error if undefined values are strict.
+func (r *renderer) evalBool(n Node) (bool, error) {
+	v, err := r.eval(n)
+	if err != nil {
+		return false, err
+	}
+	if isUndefined(v) {
+		return false, r.use(n, v)
+	}
+	b, err := asBool(v)
+	if err != nil {
+		return false, r.errorf(n, "type error: non-boolean %s (%s) used in boolean context", n, typeOf(v))
+	}
+	return b, nil
+}
+
+// evalCompare evaluates a chain of comparisons, stopping at the first one
+// which is false.
+func (r *renderer) evalCompare(n *CompareExpr) (interface{}, error) {
+	lhs, err := r.eval(n.lhs)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range n.ops {
+		rhs, err := r.eval(op.rhs)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.use(n, lhs, rhs); err != nil {
+			return nil, err
+		}
+		ok, err := evalComparison(lhs, rhs, op.operator)
+		if err != nil {
+			return nil, r.errorf(n, "%s", err)
+		}
+		if !ok {
+			return false, nil
+		}
+		lhs = rhs
+	}
+	return true, nil
+}
+
+// applyFilter calls the filter f with val as its first argument.
+func (r *renderer) applyFilter(f *FilterExpr, val interface{}) (interface{}, error) {
+	if _, ok := r.t.env.Filters[f.Name]; !ok {
+		return nil, r.errorf(f, "no filter named %q", f.Name)
+	}
+	// the default filter is how templates replace undefined values
+	if f.Name != "default" && f.Name != "d" {
+		if err := r.use(f, val); err != nil {
+			return nil, err
+		}
+	}
+	args, kwargs, err := r.evalArgs(f.Args, f.Kwargs)
+	if err != nil {
+		return nil, err
+	}
+	v, err := r.t.env.filter(f.Name, val, args, kwargs)
+	if se, ok := err.(*SecurityError); ok {
+		return nil, r.denied(f, se)
+	} else if isAbort(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, r.errorf(f, "filter %s: %s", f.Name, err)
+	}
+	return v, nil
+}
+
+// evalArgs evaluates the arguments of a call, filter or test.
+func (r *renderer) evalArgs(args []Node, kwargs []*KeywordArg) ([]interface{}, map[string]interface{}, error) {
+	vals := make([]interface{}, len(args))
+	for i, arg := range args {
+		v, err := r.eval(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := r.use(arg, v); err != nil {
+			return nil, nil, err
+		}
+		vals[i] = v
+	}
+	if len(kwargs) == 0 {
+		return vals, nil, nil
+	}
+	kwvals := make(map[string]interface{}, len(kwargs))
+	for _, kw := range kwargs {
+		v, err := r.eval(kw.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := r.use(kw.Value, v); err != nil {
+			return nil, nil, err
+		}
+		kwvals[kw.Name] = v
+	}
+	return vals, kwvals, nil
+}
+
+// getattr returns the attribute name of v.  Runtime objects provide their own
+// attributes, maps with string keys have their keys as attributes, and structs
+// have their exported fields, including those promoted from embedded structs.
+// Exported methods are also attributes, so that `user.FullName()` calls a
+// method.  Pointers and interfaces are dereferenced as needed.  If policy is
+// not nil, fields and methods which it does not allow are a *SecurityError.
+func getattr(v interface{}, name string, policy Policy) (interface{}, bool, error) {
+	if g, ok := v.(attrGetter); ok {
+		attr, ok := g.getattr(name)
+		return attr, ok, nil
+	}
+	attr, ok, err := attrValue(reflect.ValueOf(v), name, policy)
+	if !ok {
+		return nil, false, err
+	}
+	return attr.Interface(), true, nil
+}
+
+// attrValue returns the attribute name of v as described by getattr.
+func attrValue(v reflect.Value, name string, policy Policy) (reflect.Value, bool, error) {
+	attr, owner, isMethod, ok := findAttr(v, name)
+	if !ok || policy == nil || owner == nil {
+		return attr, ok, nil
+	}
+	if err := checkAttr(policy, owner, name, isMethod); err != nil {
+		return reflect.Value{}, false, err
+	}
+	if isMethod {
+		return reflect.ValueOf(method{attr}), true, nil
+	}
+	return attr, true, nil
+}
+
+// findAttr finds the attribute name of v, and returns it along with the type
+// it is a field or method of, if it is not a map item.
+func findAttr(v reflect.Value, name string) (attr reflect.Value, owner reflect.Type, isMethod bool, ok bool) {
+	for v.IsValid() {
+		if v.Kind() == reflect.Interface {
+			v = v.Elem()
+			continue
+		}
+		if v.Kind() == reflect.Map {
+			if key, ok := mapKey(v, name); ok {
+				if attr := v.MapIndex(key); attr.IsValid() {
+					return attr, nil, false, true
+				}
+			}
+		}
+		if m := v.MethodByName(name); m.IsValid() {
+			return m, v.Type(), true, true
+		}
+		switch v.Kind() {
+		case reflect.Ptr:
+			if v.IsNil() {
+				return reflect.Value{}, nil, false, false
+			}
+			v = v.Elem()
+		case reflect.Struct:
+			if f, ok := v.Type().FieldByName(name); ok && f.IsExported() {
+				attr, err := v.FieldByIndexErr(f.Index)
+				// err is non-nil if the field is in a nil embedded struct
+				return attr, v.Type(), false, err == nil && attr.CanInterface()
+			}
+			// methods with pointer receivers are only in the method set of
+			// addressable structs
+			if !v.CanAddr() {
+				p := reflect.New(v.Type())
+				p.Elem().Set(v)
+				if m := p.MethodByName(name); m.IsValid() {
+					return m, p.Type(), true, true
+				}
+			}
+			return reflect.Value{}, nil, false, false
+		default:
+			return reflect.Value{}, nil, false, false
+		}
+	}
+	return reflect.Value{}, nil, false, false
+}
+
+// mapKey returns name as a key for the map m, if m has string or interface
+// keys.
+func mapKey(m reflect.Value, name string) (reflect.Value, bool) {
+	kt := m.Type().Key()
+	switch {
+	case kt.Kind() == reflect.String:
+		return reflect.ValueOf(name).Convert(kt), true
+	case kt.Kind() == reflect.Interface && reflect.TypeOf(name).Implements(kt):
+		return reflect.ValueOf(name), true
+	}
+	return reflect.Value{}, false
+}
+
+// missingError is the error for a subscript with a missing key or an out of
+// range index.
+type missingError string
+
+func (e missingError) Error() string { return string(e) }
+
+// indirect dereferences the pointers and interfaces of v.
+func indirect(v reflect.Value) reflect.Value {
+	for (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+// index returns the item of v at key.  Strings, slices and arrays are indexed
+// by integers, which count from the end if they are negative, and strings are
+// indexed by rune.  Maps are indexed by their keys, and other values which
+// have attributes may be indexed by attribute name.
+func index(v, key interface{}, policy Policy) (interface{}, error) {
+	if isUndefined(v) {
+		return nil, missingError(fmt.Sprintf("%s is undefined", v.(undefined).name))
+	}
+	rv := indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.String:
+		runes := []rune(rv.String())
+		i, err := seqIndex(key, len(runes))
+		if err != nil {
+			return nil, err
+		}
+		return string(runes[i]), nil
+	case reflect.Slice, reflect.Array:
+		i, err := seqIndex(key, rv.Len())
+		if err != nil {
+			return nil, err
+		}
+		return rv.Index(i).Interface(), nil
+	case reflect.Map:
+		k, err := convertArg(key, rv.Type().Key())
+		if err != nil {
+			return nil, fmt.Errorf("type error: invalid map key: %s", err)
+		}
+		item := rv.MapIndex(k)
+		if !item.IsValid() {
+			return nil, missingError(fmt.Sprintf("key %#v not found", key))
+		}
+		return item.Interface(), nil
+	}
+	if name, ok := key.(string); ok {
+		if attr, ok, err := getattr(v, name, policy); ok || err != nil {
+			return attr, err
+		}
+		return nil, missingError(fmt.Sprintf("%T has no attribute %s", v, name))
+	}
+	return nil, fmt.Errorf("type error: %T is not subscriptable", v)
+}
+
+// seqIndex returns the integer key as an index into a sequence of length n.
+func seqIndex(key interface{}, n int) (int, error) {
+	if typeOf(key) != intType {
+		return 0, fmt.Errorf("type error: index must be an integer, not %s", typeOf(key))
+	}
+	i, _ := asInteger(key)
+	if i < 0 {
+		i += int64(n)
+	}
+	if i < 0 || i >= int64(n) {
+		return 0, missingError(fmt.Sprintf("index %v out of range", key))
+	}
+	return int(i), nil
+}
+
+// slice returns a python style slice of the string, slice or array v.  Nil
+// bounds are omitted.  Strings are sliced by rune and return a string, and
+// other sequences return a []interface{}.
+func slice(v, start, stop, step interface{}) (interface{}, error) {
+	if isUndefined(v) {
+		return nil, missingError(fmt.Sprintf("%s is undefined", v.(undefined).name))
+	}
+	rv := indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.String:
+		runes := []rune(rv.String())
+		indices, err := sliceIndices(len(runes), start, stop, step)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]rune, len(indices))
+		for i, idx := range indices {
+			out[i] = runes[idx]
+		}
+		return string(out), nil
+	case reflect.Slice, reflect.Array:
+		indices, err := sliceIndices(rv.Len(), start, stop, step)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]interface{}, len(indices))
+		for i, idx := range indices {
+			out[i] = rv.Index(idx).Interface()
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("type error: cannot slice %T", v)
+}
+
+// sliceIndices returns the indices selected from a sequence of length n by
+// a slice, following python's rules: negative bounds count from the end,
+// bounds out of range are clamped, and a negative step walks backwards.
+func sliceIndices(n int, start, stop, step interface{}) ([]int, error) {
+	bound := func(v interface{}) (int64, bool, error) {
+		if v == nil {
+			return 0, false, nil
+		}
+		if typeOf(v) != intType {
+			return 0, false, fmt.Errorf("type error: slice indices must be integers, not %s", typeOf(v))
+		}
+		i, _ := asInteger(v)
+		return i, true, nil
+	}
+	inc, ok, err := bound(step)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		inc = 1
+	} else if inc == 0 {
+		return nil, errors.New("slice step cannot be zero")
+	}
+	lower, upper := int64(0), int64(n)
+	if inc < 0 {
+		lower, upper = -1, int64(n)-1
+	}
+	clamp := func(v interface{}, def int64) (int64, error) {
+		i, ok, err := bound(v)
+		if err != nil || !ok {
+			return def, err
+		}
+		if i < 0 {
+			if i += int64(n); i < lower {
+				i = lower
+			}
+		} else if i > upper {
+			i = upper
+		}
+		return i, nil
+	}
+	var from, to int64
+	if inc > 0 {
+		from, err = clamp(start, lower)
+		if err == nil {
+			to, err = clamp(stop, upper)
+		}
+	} else {
+		from, err = clamp(start, upper)
+		if err == nil {
+			to, err = clamp(stop, lower)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var indices []int
+	for i := from; (inc > 0 && i < to) || (inc < 0 && i > to); i += inc {
+		indices = append(indices, int(i))
+	}
+	return indices, nil
+}
+
 // evalAdd evaluatse arithmetic expressions between an lhs and an rhs, which
 // have already been evaluated themselves and turned to interface{} values.
 // The type of the lhs determines the expected type on the rhs.  If the types
@@ -156,19 +1570,98 @@ func evalAdd(lhs, rhs interface{}, oper item) (interface{}, error) {
 
 	switch lt {
 	case stringType:
-		return arithmeticString(asString(lhs), asString(rhs), oper)
+		return arithmeticString(lhs, rhs, oper)
 	case intType:
 		l, _ := asInteger(lhs)
 		r, _ := asInteger(rhs)
+		// integers raised to negative powers are fractions
+		if oper.typ == tokenPow && r < 0 {
+			return arithmeticFloat(float64(l), float64(r), oper)
+		}
 		return arithmeticInt(l, r, oper)
 	case floatType:
-		l, _ := asFloat(lt)
-		r, _ := asFloat(rt)
+		l, _ := asFloat(lhs)
+		r, _ := asFloat(rhs)
 		return arithmeticFloat(l, r, oper)
 	}
-	return "?add", nil
+	return nil, fmt.Errorf("type error: %s not compatible with %s", lt, oper.val)
+}
+
+// evalUnary evaluates unary `+` and `-` on an evaluated value, which must be
+// numeric.
+func evalUnary(v interface{}, oper item) (interface{}, error) {
+	switch typeOf(v) {
+	case intType:
+		i, _ := asInteger(v)
+		if oper.typ != tokenSub {
+			return i, nil
+		}
+		if i == math.MinInt64 {
+			return nil, errOverflow
+		}
+		return -i, nil
+	case floatType:
+		f, _ := asFloat(v)
+		if oper.typ != tokenSub {
+			return f, nil
+		}
+		return -f, nil
+	}
+	return nil, fmt.Errorf("type error: %s not compatible with unary %s", typeOf(v), oper.val)
 }
 
+// evalComparison compares an lhs and an rhs which have already been evaluated.
+// Like evalAdd, the types of the lhs and rhs must be the same, or both be
+// numeric.  Values of any type may be compared with undefined or nil values
+// for equality, which are equal only to themselves.
+func evalComparison(lhs, rhs interface{}, oper item) (bool, error) {
+	switch oper.val {
+	case "in":
+		return contains(rhs, lhs)
+	case "not in":
+		ok, err := contains(rhs, lhs)
+		return !ok, err
+	}
+
+	lt, rt := typeOf(lhs), typeOf(rhs)
+	if oper.typ == tokenEqEq || oper.typ == tokenNeq {
+		if lhs == nil || rhs == nil || isUndefined(lhs) || isUndefined(rhs) {
+			eq := lhs == nil && rhs == nil || isUndefined(lhs) && isUndefined(rhs)
+			return eq == (oper.typ == tokenEqEq), nil
+		}
+	}
+	if lt != rt && !(isNumericVar(lt) && isNumericVar(rt)) {
+		return false, fmt.Errorf("type error: %s and %s not compatible with %s", lt, rt, oper.val)
+	}
+
+	switch oper.typ {
+	case tokenEqEq:
+		return equal(lhs, rhs), nil
+	case tokenNeq:
+		return !equal(lhs, rhs), nil
+	}
+	c, err := compare(lhs, rhs)
+	if err != nil {
+		return false, err
+	}
+	switch oper.typ {
+	case tokenLt:
+		return c < 0, nil
+	case tokenLteq:
+		return c <= 0, nil
+	case tokenGt:
+		return c > 0, nil
+	case tokenGteq:
+		return c >= 0, nil
+	}
+	return false, errors.New("Unknown operator " + oper.val)
+}
+
+var (
+	errDivByZero = errors.New("division by zero")
+	errOverflow  = errors.New("integer overflow")
+)
+
 func arithmeticFloat(lhs, rhs float64, oper item) (float64, error) {
 	switch oper.val {
 	case "+":
@@ -178,37 +1671,106 @@ func arithmeticFloat(lhs, rhs float64, oper item) (float64, error) {
 	case "*":
 		return lhs * rhs, nil
 	case "/":
+		if rhs == 0 {
+			return 0, errDivByZero
+		}
 		return lhs / rhs, nil
 	case "//":
+		if rhs == 0 {
+			return 0, errDivByZero
+		}
 		return math.Floor(lhs / rhs), nil
+	case "**":
+		return math.Pow(lhs, rhs), nil
 	case "%":
 		return 0.0, errors.New("% not defined on float")
 	}
 	return 0.0, errors.New("Unknown operator " + oper.val)
 }
 
+// arithmeticInt performs integer arithmetic, returning an error rather than
+// silently wrapping around on overflow.
 func arithmeticInt(lhs, rhs int64, oper item) (int64, error) {
 	switch oper.val {
 	case "+":
-		return lhs + rhs, nil
+		r := lhs + rhs
+		if (r > lhs) != (rhs > 0) {
+			return 0, errOverflow
+		}
+		return r, nil
 	case "-":
-		return lhs - rhs, nil
+		r := lhs - rhs
+		if (r < lhs) != (rhs > 0) {
+			return 0, errOverflow
+		}
+		return r, nil
 	case "*":
-		return lhs * rhs, nil
-	case "/":
-		return lhs / rhs, nil
-	case "//":
-		return lhs / rhs, nil
-	case "%":
-		return lhs % rhs, nil
+		return mulInt(lhs, rhs)
+	case "/", "//", "%":
+		if rhs == 0 {
+			return 0, errDivByZero
+		}
+		if lhs == math.MinInt64 && rhs == -1 {
+			if oper.val == "%" {
+				return 0, nil
+			}
+			return 0, errOverflow
+		}
+		switch oper.val {
+		case "/":
+			return lhs / rhs, nil
+		case "%":
+			return lhs % rhs, nil
+		}
+		// floor division rounds towards negative infinity
+		q := lhs / rhs
+		if (lhs%rhs != 0) && ((lhs < 0) != (rhs < 0)) {
+			q--
+		}
+		return q, nil
+	case "**":
+		return powInt(lhs, rhs)
 	}
 	return 0.0, errors.New("Unknown operator " + oper.val)
 }
 
-func arithmeticString(lhs, rhs string, oper item) (string, error) {
+// mulInt multiplies two integers, checking for overflow.
+func mulInt(lhs, rhs int64) (int64, error) {
+	if lhs == 0 || rhs == 0 {
+		return 0, nil
+	}
+	r := lhs * rhs
+	if r/rhs != lhs || (lhs == -1 && rhs == math.MinInt64) || (rhs == -1 && lhs == math.MinInt64) {
+		return 0, errOverflow
+	}
+	return r, nil
+}
+
+// powInt raises base to a non-negative integer power, checking for overflow.
+func powInt(base, exp int64) (int64, error) {
+	result := int64(1)
+	for exp > 0 {
+		var err error
+		if exp&1 == 1 {
+			if result, err = mulInt(result, base); err != nil {
+				return 0, err
+			}
+		}
+		if exp >>= 1; exp > 0 {
+			if base, err = mulInt(base, base); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// arithmeticString adds strings lhs and rhs, which is the only arithmetic
+// defined on strings.  Adding Markup escapes the other string.
+func arithmeticString(lhs, rhs interface{}, oper item) (interface{}, error) {
 	if oper.val != "+" {
-		return "", errors.New(oper.val + " not defined on string")
+		return nil, errors.New(oper.val + " not defined on string")
 	}
-	return lhs + rhs, nil
+	return concat(lhs, rhs), nil
 
 }
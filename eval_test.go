@@ -1,15 +1,63 @@
 package jigo
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
 
 type m map[string]interface{}
 
+type evalFixture struct {
+	name, body string
+	context    interface{}
+	result     string
+}
+
+// testFixtures renders each fixture in the environment e and checks its output.
+func testFixtures(t *testing.T, e *Environment, fixtures []evalFixture) {
+	for _, fixture := range fixtures {
+		template, err := e.ParseString(fixture.body, fixture.name, "temp")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		result, err := template.Render(fixture.context)
+		if err != nil {
+			t.Errorf("Test %s: unexpected error %s\n", fixture.name, err)
+			continue
+		}
+		if result != fixture.result {
+			t.Errorf("Test %s: Expected:\n`%s`\nGot:\n`%s`\n", fixture.name, fixture.result, result)
+		}
+	}
+}
+
+// testRenderErrors parses each of sources in the environment e and checks
+// that rendering it with data fails with an error located in the template.
+func testRenderErrors(t *testing.T, e *Environment, sources []string, data interface{}) {
+	t.Helper()
+	for _, source := range sources {
+		tpl, err := e.ParseString(source, "test", "test")
+		if err != nil {
+			t.Errorf("%s: unexpected parse error %s", source, err)
+			continue
+		}
+		if _, err := tpl.Render(data); err == nil {
+			t.Errorf("%s: expected render error", source)
+		} else if !strings.HasPrefix(err.Error(), "template: test:1:") {
+			t.Errorf("%s: expected positioned error, got %s", source, err)
+		}
+	}
+}
+
 func TestSimpleEval(t *testing.T) {
-	fixtures := []struct {
-		name, body string
-		context    m
-		result     string
-	}{
+	fixtures := []evalFixture{
 		{"Hello, World", "Hello, World", m{}, "Hello, World"},
 		{"Comment", "Hello, {# comment #}World", m{}, "Hello, World"},
 		{"Variable", "Hello {{ name }}", m{"name": "Jason"}, "Hello Jason"},
@@ -22,7 +70,7 @@ func TestSimpleEval(t *testing.T) {
 		{"Math", "{{ 1 + 2 }}", m{}, "3"},
 		{"Cat", `{{ "foo" + "bar" }}`, m{}, "foobar"},
 		{"Cat Var", `{{ foo + "bar" }}`, m{"foo": "baz"}, "bazbar"},
-		//{"CoerceConcat", `{{ 1 ~ "1" }}`, m{}, "11"},
+		{"CoerceConcat", `{{ 1 ~ "1" }}`, m{}, "11"},
 		{
 			"Conditional",
 			`{% if true %}true{% else %}false{% endif %}`,
@@ -35,23 +83,7 @@ func TestSimpleEval(t *testing.T) {
 	}
 
 	// use defaults
-	e := NewEnvironment()
-
-	for _, fixture := range fixtures {
-		template, err := e.ParseString(fixture.body, fixture.name, "temp")
-		if err != nil {
-			t.Error(err)
-			continue
-		}
-		result, err := template.Render(fixture.context)
-		if err != nil {
-			t.Errorf("Test %s: unexpected error %s\n", fixture.name, err)
-			continue
-		}
-		if result != fixture.result {
-			t.Errorf("Test %s: Expected:\n`%s`\nGot:\n`%s`\n", fixture.name, fixture.result, result)
-		}
-	}
+	testFixtures(t, NewEnvironment(), fixtures)
 
 	/*
 		tester.Test(
@@ -85,3 +117,1127 @@ func TestSimpleEval(t *testing.T) {
 		)
 	*/
 }
+
+func TestForLoop(t *testing.T) {
+	ch := make(chan string, 3)
+	ch <- "a"
+	ch <- "b"
+	close(ch)
+	lazy := make(chan string, 2)
+	lazy <- "a"
+	lazy <- "b"
+	close(lazy)
+
+	fixtures := []evalFixture{
+		{"Slice", `{% for x in items %}{{ x }},{% endfor %}`, m{"items": []int{1, 2, 3}}, "1,2,3,"},
+		{"Array", `{% for x in items %}{{ x }}{% endfor %}`, m{"items": [2]string{"a", "b"}}, "ab"},
+		{"Map Keys", `{% for k in m %}{{ k }}{% endfor %}`, m{"m": map[string]int{"b": 2, "a": 1, "c": 3}}, "abc"},
+		{"Int Keys", `{% for k in m %}{{ k }} {% endfor %}`, m{"m": map[int]bool{10: true, 9: true, 100: true}}, "9 10 100 "},
+		{"Map Unpack", `{% for k, v in m %}{{ k }}={{ v }};{% endfor %}`, m{"m": map[string]int{"b": 2, "a": 1}}, "a=1;b=2;"},
+		{"Slice Unpack", `{% for a, b in pairs %}{{ b }}{{ a }}{% endfor %}`, m{"pairs": [][]string{{"1", "2"}, {"3", "4"}}}, "2143"},
+		{"Channel", `{% for x in ch %}{{ x }}{% endfor %}`, m{"ch": ch}, "ab"},
+		{"Channel Loop", `{% for x in ch %}{{ x }}{{ loop.nextitem }}{% if loop.last %}.{{ loop.length }}{% endif %};{% endfor %}`, m{"ch": lazy}, "ab;b.2;"},
+		{"Else", `{% for x in items %}{{ x }}{% else %}empty{% endfor %}`, m{"items": []int{}}, "empty"},
+		{"Else Missing", `{% for x in nothing %}{{ x }}{% else %}empty{% endfor %}`, m{}, "empty"},
+		{"Nested", `{% for r in rows %}{% for c in r %}{{ c }}{% endfor %};{% endfor %}`, m{"rows": [][]int{{1, 2}, {3}}}, "12;3;"},
+		{"Scope", `{% for x in items %}{% endfor %}{{ x }}`, m{"items": []int{1}, "x": "outer"}, "outer"},
+		{
+			"Loop Index",
+			`{% for x in items %}{{ loop.index }}{{ loop.index0 }}{{ loop.revindex }}{{ loop.revindex0 }} {% endfor %}`,
+			m{"items": []string{"a", "b"}},
+			"1021 2110 ",
+		},
+		{
+			"Loop First Last",
+			`{% for x in items %}{% if loop.first %}[{% endif %}{{ x }}{% if loop.last %}]{% endif %}{% endfor %}`,
+			m{"items": []string{"a", "b", "c"}},
+			"[abc]",
+		},
+		{"Loop Length", `{% for x in items %}{{ loop.length }}{% endfor %}`, m{"items": []int{1, 2}}, "22"},
+		{
+			"Loop Prev Next",
+			`{% for x in items %}({{ loop.previtem }}<{{ x }}>{{ loop.nextitem }}){% endfor %}`,
+			m{"items": []int{1, 2, 3}},
+			"(<1>2)(1<2>3)(2<3>)",
+		},
+		{
+			"Loop Cycle",
+			`{% for x in items %}{{ loop.cycle("odd", "even") }} {% endfor %}`,
+			m{"items": []int{1, 2, 3}},
+			"odd even odd ",
+		},
+	}
+
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestForLoopErrors(t *testing.T) {
+	e := NewEnvironment()
+	testRenderErrors(t, e, []string{
+		`{% for x in 1 %}{% endfor %}`,
+		`{% for a, b in ints %}{% endfor %}`,
+		`{% for a, b in triples %}{% endfor %}`,
+	}, m{"ints": []int{1}, "triples": [][]int{{1, 2, 3}}})
+}
+
+func TestInheritance(t *testing.T) {
+	e := NewEnvironment()
+	e.Loader = MapLoader{
+		"base.html":    `<title>{% block title %}Base{% endblock %}</title>{% block body %}<p>{% block content %}base content{% endblock content %}</p>{% endblock %}`,
+		"child.html":   `{% extends "base.html" %}ignored{% block title %}Child - {{ super() }}{% endblock %}`,
+		"nested.html":  `{% extends "child.html" %}{% block content %}{{ name }}{% endblock %}`,
+		"grand.html":   `{% extends "nested.html" %}{% block title %}Grand / {{ super() }}{% endblock %}{% block content %}[{{ super() }}]{% endblock %}`,
+		"dynamic.html": `{% extends parent %}{% block title %}Dynamic{% endblock %}`,
+		"loop.html":    `{% extends "base.html" %}{% block content %}{% for x in items %}{{ x }}{% endfor %}{% endblock %}`,
+		"set.html":     `{% extends "base.html" %}{% set title = "Set" %}{% block title %}{{ title }}{% endblock %}`,
+		"wrapped.html": `{% filter upper %}{% block a %}a{% endblock %}{% endfilter %}{% autoescape false %}{% block b %}b{% endblock %}{% endautoescape %}` +
+			`{% set c %}{% block c %}c{% endblock %}{% endset %}{{ c }}{% macro m() %}{% block d %}d{% endblock %}{{ caller() }}{% endmacro %}` +
+			`{% call m() %}{% block e %}e{% endblock %}{% endcall %}`,
+		"wrapper.html": `{% extends "wrapped.html" %}{% block a %}1{{ super() }}{% endblock %}{% block b %}2{% endblock %}{% block c %}3{% endblock %}` +
+			`{% block d %}4{% endblock %}{% block e %}5{% endblock %}`,
+	}
+
+	fixtures := []struct {
+		name    string
+		context interface{}
+		result  string
+	}{
+		{"base.html", m{}, "<title>Base</title><p>base content</p>"},
+		{"child.html", m{}, "<title>Child - Base</title><p>base content</p>"},
+		{"nested.html", m{"name": "Jason"}, "<title>Child - Base</title><p>Jason</p>"},
+		{"grand.html", m{"name": "Jason"}, "<title>Grand / Child - Base</title><p>[Jason]</p>"},
+		{"dynamic.html", m{"parent": "base.html"}, "<title>Dynamic</title><p>base content</p>"},
+		{"loop.html", m{"items": []int{1, 2}}, "<title>Base</title><p>12</p>"},
+		{"set.html", m{}, "<title>Set</title><p>base content</p>"},
+		{"wrapped.html", m{}, "Abcde"},
+		{"wrapper.html", m{}, "1A2345"},
+	}
+
+	for _, fixture := range fixtures {
+		tpl, err := e.Load(fixture.name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		result, err := tpl.Render(fixture.context)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", fixture.name, err)
+			continue
+		}
+		if result != fixture.result {
+			t.Errorf("%s: Expected:\n`%s`\nGot:\n`%s`\n", fixture.name, fixture.result, result)
+		}
+	}
+}
+
+func TestInheritanceErrors(t *testing.T) {
+	e := NewEnvironment()
+	e.Loader = MapLoader{
+		"base.html":    `{% block title %}{{ super() }}{% endblock %}`,
+		"missing.html": `{% extends "nope.html" %}`,
+		"double.html":  `{% extends "base.html" %}{% extends "base.html" %}`,
+		"self.html":    `{% extends "self.html" %}`,
+		"a.html":       `{% extends "b.html" %}`,
+		"b.html":       `{% extends "a.html" %}`,
+	}
+	for _, name := range []string{"base.html", "missing.html", "double.html", "self.html", "a.html"} {
+		tpl, err := e.Load(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tpl.Render(m{}); err == nil {
+			t.Errorf("%s: expected render error", name)
+		}
+	}
+	tpl, err := e.Load("a.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.Render(m{}); err == nil || err.Error() != "template: b.html:1:12: extends cycle: a.html -> b.html -> a.html" {
+		t.Errorf("expected extends cycle error, got %v", err)
+	}
+
+	for _, source := range []string{
+		`{% block a %}{% endblock %}{% block a %}{% endblock %}`,
+		`{% block a %}{% endblock b %}`,
+		`{% block a %}`,
+	} {
+		if _, err := e.ParseString(source, "test", "test"); err == nil {
+			t.Errorf("%s: expected parse error", source)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	e := NewEnvironment()
+	e.Filters["upper"] = strings.ToUpper
+	e.Filters["repeat"] = strings.Repeat
+	e.Filters["wrap"] = func(s string, args Args, kwargs Kwargs) string {
+		left, right := "[", "]"
+		if len(args) > 0 {
+			left = fmt.Sprint(args[0])
+		}
+		if r, ok := kwargs["right"]; ok {
+			right = fmt.Sprint(r)
+		}
+		return left + s + right
+	}
+	e.Filters["fail"] = func(v interface{}) (interface{}, error) {
+		return nil, errors.New("failed")
+	}
+
+	fixtures := []evalFixture{
+		{"Filter", `{{ name|upper }}`, m{"name": "jason"}, "JASON"},
+		{"Filter Args", `{{ "ab"|repeat(3) }}`, m{}, "ababab"},
+		{"Filter Chain", `{{ name | upper | repeat(2) }}`, m{"name": "go"}, "GOGO"},
+		{"Filter Args Expr", `{{ name|repeat(n + 1) }}`, m{"name": "x", "n": 2}, "xxx"},
+		{"Filter Varargs", `{{ name|wrap }} {{ name|wrap("<") }}`, m{"name": "a"}, "[a] <a]"},
+		{"Filter Kwargs", `{{ name|wrap("<", right=">") }}`, m{"name": "a"}, "<a>"},
+		{"Filter Attr", `{{ user.name|upper }}`, m{"user": m{"name": "bob"}}, "BOB"},
+		{"Filter Block", `{% filter upper %}hello {{ name }}{% endfilter %}`, m{"name": "you"}, "HELLO YOU"},
+		{"Filter Block Chain", `{% filter upper|wrap(right=")") %}x{% endfilter %}`, m{}, "[X)"},
+	}
+	testFixtures(t, e, fixtures)
+
+	for _, source := range []string{
+		`{{ name|nope }}`,
+		`{% filter nope %}{% endfilter %}`,
+		`{{ name|wrap(right=">", "<") }}`,
+		`{{ name| }}`,
+		`{% filter upper %}unclosed`,
+	} {
+		if _, err := e.ParseString(source, "test", "test"); err == nil {
+			t.Errorf("%s: expected parse error", source)
+		}
+	}
+
+	testRenderErrors(t, e, []string{
+		`{{ name|fail }}`,
+		`{{ name|repeat }}`,
+		`{{ name|repeat("x") }}`,
+		`{{ name|upper(right=1) }}`,
+	}, m{"name": "a"})
+}
+
+func TestComparisons(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Eq", `{{ 1 == 1 }} {{ 1 == 2 }} {{ 1 != 2 }} {{ "a" == "a" }}`, m{}, "true false true true"},
+		{"Mixed Numeric", `{{ 1 == 1.0 }} {{ 1 < 1.5 }} {{ n >= 2 }}`, m{"n": uint8(2)}, "true true true"},
+		{"Ordering", `{{ 1 < 2 }} {{ 2 <= 1 }} {{ 2 > 1 }} {{ 1 >= 1 }} {{ "a" < "b" }}`, m{}, "true false true true true"},
+		{"Chained", `{{ 1 < x < 10 }} {{ 1 < y < 10 }} {{ 1 < 2 == 2 }}`, m{"x": 5, "y": 10}, "true false true"},
+		{"Precedence", `{{ 1 + 2 == 3 }} {{ 3 > 1 + 1 }}`, m{}, "true true"},
+		{"Slices", `{{ a == b }} {{ a != b }}`, m{"a": []int{1}, "b": []int{1}}, "true false"},
+		{"Undefined", `{{ missing == 1 }} {{ missing != "x" }} {{ missing == other }}`, m{}, "false true true"},
+		{"In", `{{ 2 in l }} {{ 3 in l }} {{ 3 not in l }} {{ "ell" in "hello" }} {{ "k" in d }}`, m{"l": []int{1, 2}, "d": m{"k": 1}}, "true false true true true"},
+		{"If", `{% if n > 1 %}big{% elif n == 1 %}one{% else %}small{% endif %}`, m{"n": 1}, "one"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestBooleanOperators(t *testing.T) {
+	fail := func() (bool, error) { return false, errors.New("evaluated") }
+	fixtures := []evalFixture{
+		{"And", `{{ true and true }} {{ true and false }} {{ true && false }}`, m{}, "true false false"},
+		{"Or", `{{ false or true }} {{ false or false }} {{ false || true }}`, m{}, "true false true"},
+		{"Not", `{{ not true }} {{ !false }} {{ not not true }} {{ not 1 == 2 }}`, m{}, "false true true true"},
+		{"Precedence", `{{ true or true and false }} {{ (true or true) and false }} {{ not false and false }}`, m{}, "true false false"},
+		{"Short Circuit", `{{ false and f() }} {{ true or f() }}`, m{"f": fail}, "false true"},
+		{"Tests", `{% if x is defined and x > 1 %}yes{% else %}no{% endif %}`, m{}, "no"},
+		{"Parens", `{{ 1 - (2 - 3) == 2 }}`, m{}, "true"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestOperatorErrors(t *testing.T) {
+	e := NewEnvironment()
+	testRenderErrors(t, e, []string{
+		`{{ 1 == "1" }}`,
+		`{{ 1 < "a" }}`,
+		`{{ a < b }}`,
+		`{{ 1 and true }}`,
+		`{{ true and "x" }}`,
+		`{{ not 1 }}`,
+		`{{ 1 in 2 }}`,
+		`{% if 1 %}{% endif %}`,
+	}, m{"a": []int{1}, "b": []int{2}})
+	for _, source := range []string{
+		`{{ 1 == }}`,
+		`{{ 1 not 2 }}`,
+		`{{ and }}`,
+		`{{ (1 }}`,
+		`{{ 1 2 }}`,
+	} {
+		if _, err := e.ParseString(source, "test", "test"); err == nil {
+			t.Errorf("%s: expected parse error", source)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Mul", `{{ 2 * 3 }} {{ 7 / 2 }} {{ 7 // 2 }} {{ -7 // 2 }} {{ 7 % 3 }}`, m{}, "6 3 3 -4 1"},
+		{"Float", `{{ 1.5 * 2 }} {{ 7.0 / 2 }} {{ 7 // 2.0 }} {{ x * 2 }}`, m{"x": 0.25}, "3 3.5 3 0.5"},
+		{"Precedence", `{{ 1 + 2 * 3 + 4 }} {{ (1 + 2) * 3 }} {{ 10 - 2 - 3 }} {{ 2 * 3 % 4 }}`, m{}, "11 9 5 2"},
+		{"Pow", `{{ 2 ** 4 }} {{ 2 ** 3 ** 2 }} {{ 2 * 3 ** 2 }} {{ 2 ** -1 }} {{ 2.0 ** 0.5 > 1.41 }}`, m{}, "16 512 18 0.5 true"},
+		{"Unary", `{{ -1 }} {{ -1.5 + 1 }} {{ -x }} {{ +x }} {{ 3 - -x }} {{ -x|abs }}`, m{"x": 2}, "-1 -0.5 -2 2 5 2"},
+		{"Concat", `{{ 1 ~ "1" }} {{ "a" ~ b ~ 2.5 }} {{ 1 + 2 ~ 3 }} {{ x ~ "!" }}`, m{"b": true}, "11 atrue2.5 33 !"},
+		{"Concat None", `{{ "x" ~ 1 ~ none }}|{{ none ~ n }}`, m{"n": nil}, "x1|"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestArithmeticErrors(t *testing.T) {
+	e := NewEnvironment()
+	testRenderErrors(t, e, []string{
+		`{{ 1 / 0 }}`,
+		`{{ 1 // zero }}`,
+		`{{ 1 % 0 }}`,
+		`{{ 1.5 / 0 }}`,
+		`{{ 1.5 % 2 }}`,
+		`{{ big + 1 }}`,
+		`{{ big * 2 }}`,
+		`{{ 0 - big - 2 }}`,
+		`{{ 2 ** 64 }}`,
+		`{{ -small }}`,
+		`{{ -"a" }}`,
+		`{{ "a" * 2 }}`,
+		`{{ true + true }}`,
+		`{{ missing + 1 }}`,
+	}, m{"zero": 0, "big": int64(math.MaxInt64), "small": int64(math.MinInt64)})
+}
+
+type profile struct {
+	Name string
+	Tags map[string]string
+}
+
+type base struct {
+	ID int
+}
+
+func (b base) Kind() string { return "base" }
+
+type account struct {
+	*base
+	Profile  profile
+	Manager  *account
+	Settings interface{}
+	first    string
+	last     string
+}
+
+func (a account) FullName() string  { return a.first + " " + a.last }
+func (a *account) Initials() string { return a.first[:1] + a.last[:1] }
+func (a *account) Greet(greeting string) string {
+	return greeting + ", " + a.first
+}
+
+type labels map[string]string
+
+func (l labels) Count() int { return len(l) }
+
+func TestAttributes(t *testing.T) {
+	boss := &account{base: &base{ID: 1}, Profile: profile{Name: "Boss"}, first: "Jane", last: "Doe"}
+	user := account{
+		base:     &base{ID: 2},
+		Profile:  profile{Name: "jmoiron", Tags: map[string]string{"lang": "go"}},
+		Manager:  boss,
+		Settings: map[string]interface{}{"theme": "dark"},
+		first:    "Jason",
+		last:     "Moiron",
+	}
+	fixtures := []evalFixture{
+		{"Struct Field", `{{ user.Profile.Name }}`, m{"user": user}, "jmoiron"},
+		{"Pointer", `{{ user.Profile.Name }} {{ user.Manager.Profile.Name }}`, m{"user": &user}, "jmoiron Boss"},
+		{"Map Key", `{{ user.Profile.Tags.lang }} {{ d.a.b }}`, m{"user": user, "d": m{"a": m{"b": 1}}}, "go 1"},
+		{"Interface", `{{ user.Settings.theme }}`, m{"user": user}, "dark"},
+		{"Embedded", `{{ user.ID }} {{ user.Kind() }} {{ user.base is defined }}`, m{"user": user}, "2 base false"},
+		{"Method", `{{ user.FullName() }} {{ user.Manager.FullName() }}`, m{"user": user}, "Jason Moiron Jane Doe"},
+		{"Pointer Method", `{{ user.Initials() }} {{ ptr.Initials() }} {{ ptr.Greet("Hi") }}`, m{"user": user, "ptr": &user}, "JM JM Hi, Jason"},
+		{"Map Method", `{{ l.Count() }} {{ l.a }}`, m{"l": labels{"a": "x"}}, "1 x"},
+		{"Missing", `{{ user.Nope }}|{{ user.first }}|{{ user.Manager.Manager.Profile }}|{{ d.x }}`, m{"user": user, "d": m{}}, "|||"},
+		{"Defined", `{{ user.Nope is defined }} {{ user.ID is defined }}`, m{"user": user}, "false true"},
+		{"Struct Context", `{{ Profile.Name }} {{ FullName() }} {{ Initials() }}`, &user, "jmoiron Jason Moiron JM"},
+		{"Nil Embedded", `{{ a.ID }}|{{ a.ID is defined }}`, m{"a": account{}}, "|false"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestSubscripts(t *testing.T) {
+	l := []int{1, 2, 3, 4, 5}
+	fixtures := []evalFixture{
+		{"Index", `{{ l[0] }}{{ l[-1] }}{{ l[i] }}{{ a[1] }}`, m{"l": l, "a": [3]string{"x", "y", "z"}, "i": 2}, "153y"},
+		{"String Index", `{{ s[0] }}{{ s[-1] }}`, m{"s": "日本語"}, "日語"},
+		{"Map Key", `{{ d["a"] }} {{ d[k] }} {{ n[2] }}`, m{"d": m{"a": 1, "b": 2}, "k": "b", "n": map[int]string{2: "two"}}, "1 2 two"},
+		{"Attribute", `{{ user["Profile"]["Name"] }} {{ loop_items[0]["x"] }}`, m{"user": account{Profile: profile{Name: "jo"}}, "loop_items": []m{{"x": 1}}}, "jo 1"},
+		{"Chained", `{{ l[1:][0] }} {{ d.l[1] }} {{ d["l"][1:]|join }}`, m{"l": l, "d": m{"l": l}}, "2 2 2345"},
+		{"Slice", `{{ l[1:3]|join }} {{ l[:2]|join }} {{ l[3:]|join }} {{ l[:]|join }}`, m{"l": l}, "23 12 45 12345"},
+		{"Slice Negative", `{{ l[1:-1]|join }} {{ l[-2:]|join }} {{ l[:-10]|join }}|{{ l[-10:2]|join }}`, m{"l": l}, "234 45 |12"},
+		{"Slice Step", `{{ l[::2]|join }} {{ l[1:-1:2]|join }} {{ l[::-1]|join }} {{ l[3:0:-2]|join }} {{ l[10::-3]|join }}`, m{"l": l}, "135 24 54321 42 52"},
+		{"String Slice", `{{ name[:3] }} {{ name[::-1] }} {{ s[1:] }}`, m{"name": "jmoiron", "s": "日本語"}, "jmo noriomj 本語"},
+		{"Literal", `{{ "abc"[1] }} {{ "abc"[::-1] }} {{ "日本語"[-1] }} {{ [1, 2][1] }} {{ {"a": 1}["a"] }}`, m{}, "b cba 語 2 1"},
+		{"Out Of Range", `{{ l[5] }}|{{ l[-6] }}|{{ d["x"] }}|{{ l[9] is defined }}`, m{"l": l, "d": m{}}, "|||false"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestSubscriptErrors(t *testing.T) {
+	e := NewEnvironment()
+	testRenderErrors(t, e, []string{
+		`{{ l["a"] }}`,
+		`{{ l[1.5] }}`,
+		`{{ l[::0] }}`,
+		`{{ l["a":] }}`,
+		`{{ n[0] }}`,
+		`{{ n[1:] }}`,
+		`{{ d[1] }}`,
+	}, m{"l": []int{1}, "n": 1, "d": m{}})
+
+	// missing keys and out of range indices are errors if undefined is strict
+	e.Undefined = StrictUndefined
+	testRenderErrors(t, e, []string{`{{ l[1] }}`, `{{ l[-2] }}`, `{{ d["x"] }}`, `{{ s[3] }}`}, m{"l": []int{1}, "d": m{}, "s": "abc"})
+	tpl, err := e.ParseString(`{{ l[0] }}{{ l[1:9]|join }}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := tpl.Render(m{"l": []int{1, 2}}); err != nil || out != "12" {
+		t.Errorf("expected 12, got %q (%v)", out, err)
+	}
+}
+
+func TestLiterals(t *testing.T) {
+	count := func(l []interface{}) int { return len(l) }
+	fixtures := []evalFixture{
+		{"List", `{{ [1, "a", 2.5, true]|join(",") }} {{ []|length }} {{ [1, 2,]|length }}`, m{}, "1,a,2.5,true 0 2"},
+		{"Nested List", `{{ [[1, 2], [x, [3]]][1][1][0] }} {{ [[1, 2], [3]]|map("length")|join }}`, m{"x": 0}, "3 21"},
+		{"Map", `{{ {"a": 1, "b": [2, 3]}.b[1] }} {{ {"a": x}["a"] }} {{ {}|length }}`, m{"x": "y"}, "3 y 0"},
+		{"Map Keys", `{{ {1: "one", "1.5": "x"}["1"] }} {{ {1.5: "y"}["1.5"] }}`, m{}, "one y"},
+		{"Tuple", `{{ (1, 2)|join }} {{ (1,)|length }} {{ ()|length }} {{ (1, (2, 3))[1][0] }} {{ (1) + 1 }}`, m{}, "12 1 0 2 2"},
+		{"For", `{% for x in [1, 2] %}{{ x }}{% endfor %}{% for a, b in [(1, 2), (3, 4)] %}{{ a + b }}{% endfor %}`, m{}, "1237"},
+		{"For Map", `{% for k, v in {"b": 2, "a": 1} %}{{ k }}{{ v }}{% endfor %}`, m{}, "a1b2"},
+		{"Call", `{{ count([1, 2, 3]) }} {{ count((x, x)) }}`, m{"count": count, "x": 1}, "3 2"},
+		{"In", `{{ 2 in [1, 2] }} {{ "a" in {"a": 1} }} {{ 3 in (1, 2) }}`, m{}, "true true false"},
+		{"Constants", `{{ True }} {{ False }} {{ none is none }} {{ None is none }} [{{ none }}] {{ [none, 1]|length }}`, m{}, "true false true true [] 2"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+type price struct {
+	amount int
+}
+
+func (p price) Format(currency string, kw Kwargs) string {
+	if sep, ok := kw["sep"].(string); ok {
+		return fmt.Sprintf("%d%s%s", p.amount, sep, currency)
+	}
+	return fmt.Sprintf("%d %s", p.amount, currency)
+}
+
+func TestCalls(t *testing.T) {
+	fmtPrice := func(amount float64, kw Kwargs) string {
+		currency, ok := kw["currency"].(string)
+		if !ok {
+			currency = "USD"
+		}
+		return fmt.Sprintf("%.2f %s", amount, currency)
+	}
+	join := func(sep string, items ...string) string { return strings.Join(items, sep) }
+	count := func(args Args, kw Kwargs) int { return len(args) + len(kw) }
+	check := func(ok bool) (string, error) {
+		if !ok {
+			return "", errors.New("check failed")
+		}
+		return "ok", nil
+	}
+	fixtures := []evalFixture{
+		{"Kwargs", `{{ fmt_price(amount, currency="EUR") }} {{ fmt_price(3) }}`, m{"fmt_price": fmtPrice, "amount": 1.5}, "1.50 EUR 3.00 USD"},
+		{"Variadic", `{{ join("-", "a", "b") }}{{ join(",") }}`, m{"join": join}, "a-b"},
+		{"Args Kwargs", `{{ count() }} {{ count(1, 2, x=3) }}`, m{"count": count}, "0 3"},
+		{"Method", `{{ p.Format("EUR") }} {{ p.Format("EUR", sep="/") }}`, m{"p": price{5}}, "5 EUR 5/EUR"},
+		{"Globals", `{{ double(21) }}`, m{}, "42"},
+		{"Conversion", `{{ sum8(1, 2) }} {{ words(["a", "b"]) }}`, m{"sum8": func(a, b int8) int8 { return a + b }, "words": func(w []string) string { return strings.Join(w, " ") }}, "3 a b"},
+		{"Error Return", `{{ check(true) }}`, m{"check": check}, "ok"},
+		{"Nested", `{{ join(",", l[0], join("", l[1], "!")) }}`, m{"join": join, "l": []string{"a", "b"}}, "a,b!"},
+	}
+	e := NewEnvironment()
+	e.Globals["double"] = func(n int) int { return n * 2 }
+	testFixtures(t, e, fixtures)
+}
+
+func TestCallErrors(t *testing.T) {
+	e := NewEnvironment()
+	testRenderErrors(t, e, []string{
+		`{{ check(false) }}`,
+		`{{ check() }}`,
+		`{{ check(true, false) }}`,
+		`{{ check(1) }}`,
+		`{{ check(ok=true) }}`,
+		`{{ name() }}`,
+		`{{ missing() }}`,
+		`{{ small(300) }}`,
+		`{{ boom() }}`,
+	}, m{
+		"check": func(ok bool) (string, error) {
+			if !ok {
+				return "", errors.New("check failed")
+			}
+			return "ok", nil
+		},
+		"name":  "x",
+		"small": func(i int8) int8 { return i },
+		"boom":  func() int { panic("boom") },
+	})
+}
+
+func TestSet(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Set", `{% set x = 1 + 2 %}{{ x }}`, m{}, "3"},
+		{"Shadow", `{{ x }}{% set x = "b" %}{{ x }}`, m{"x": "a"}, "ab"},
+		{"Multiple", `{% set a, b = pair %}{{ a }}{{ b }}{% set a, b = b, a %}{{ a }}{{ b }}`, m{"pair": []int{1, 2}}, "1221"},
+		{"Block", `{% set body %}Hello {{ name }}{% endset %}[{{ body }}]`, m{"name": "Ann"}, "[Hello Ann]"},
+		{"Block Filters", `{% set body|upper|replace("L", "_") %}hello{% endset %}{{ body }}`, m{}, "HE__O"},
+		{"Loop Scope", `{% set x = 0 %}{% for i in [1, 2] %}{% set x = i %}{{ x }}{% endfor %}{{ x }}`, m{}, "120"},
+		{"Namespace", `{% set ns = namespace(found=false, n=0) %}{% for i in l %}{% if i > 1 %}{% set ns.found = true %}{% endif %}{% set ns.n = ns.n + i %}{% endfor %}{{ ns.found }} {{ ns.n }}`, m{"l": []int{1, 2, 3}}, "true 6"},
+		{"Namespace Map", `{% set ns = namespace({"a": 1}, b=2) %}{{ ns.a }}{{ ns.b }}{{ ns.c is defined }}`, m{}, "12false"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestSetErrors(t *testing.T) {
+	e := NewEnvironment()
+	testRenderErrors(t, e, []string{
+		`{% set a, b = 1 %}`,
+		`{% set a, b = [1, 2, 3] %}`,
+		`{% set x.y = 1 %}`,
+		`{% set missing.y = 1 %}`,
+		`{% set ns = namespace(1) %}`,
+	}, m{"x": m{}})
+}
+
+func TestMacros(t *testing.T) {
+	input := `{% macro input(name, value="", type="text") %}<input type="{{ type }}" name="{{ name }}" value="{{ value }}">{% endmacro %}`
+	fixtures := []evalFixture{
+		{"Defaults", input + `{{ input("user") }}|{{ input("pw", type="password") }}|{{ input("n", 1, "number") }}`, m{},
+			`<input type="text" name="user" value="">|<input type="password" name="pw" value="">|<input type="number" name="n" value="1">`},
+		{"Missing Argument", `{% macro m(a, b) %}{{ a }}[{{ b }}]{{ b is defined }}{% endmacro %}{{ m(1) }}`, m{}, "1[]false"},
+		{"Default Refers To Param", `{% macro m(a, b=a * 2) %}{{ a }},{{ b }}{% endmacro %}{{ m(2) }} {{ m(2, 3) }}`, m{}, "2,4 2,3"},
+		{"Varargs", `{% macro m(a) %}{{ a }}:{{ varargs|join(",") }}:{{ kwargs|dictsort|map("join", "=")|join(",") }}{% endmacro %}{{ m(1, 2, 3, x=4, y=5) }}`, m{}, "1:2,3:x=4,y=5"},
+		{"Nested Varargs", `{% macro m() %}{% macro n() %}{{ varargs|length }}{% endmacro %}{{ n() }}{% endmacro %}{{ m(1, 2) }}`, m{}, "0"},
+		{"Scope", `{% set x = "outer" %}{% macro m() %}{{ x }}{% set x = "inner" %}{{ x }}{% endmacro %}{{ m() }}{{ x }}`, m{}, "outerinnerouter"},
+		{"Context", `{% macro greet() %}Hi {{ name }}{% endmacro %}{% for name in ["a"] %}{{ greet() }}{% endfor %}`, m{"name": "ctx"}, "Hi ctx"},
+		{"Recursion", `{% macro count(n) %}{{ n }}{% if n > 0 %}{{ count(n - 1) }}{% endif %}{% endmacro %}{{ count(3) }}`, m{}, "3210"},
+		{"Filter", `{% macro m() %}abc{% endmacro %}{{ m()|upper }} {{ m is callable }}`, m{}, "ABC true"},
+		{"Caller", `{% macro wrap() %}<div>{{ caller() }}</div>{% endmacro %}{% call wrap() %}Hello {{ name }}{% endcall %}`, m{"name": "Ann"}, "<div>Hello Ann</div>"},
+		{"Caller Args", `{% macro table(items) %}<table>{% for item in items %}<tr>{{ caller(item, loop.index) }}</tr>{% endfor %}</table>{% endmacro %}{% call(row, i=0) table(rows) %}<td>{{ i }}:{{ row }}</td>{% endcall %}`,
+			m{"rows": []string{"a", "b"}}, "<table><tr><td>1:a</td></tr><tr><td>2:b</td></tr></table>"},
+		{"Nested Call", `{% macro outer() %}({{ caller() }}){% endmacro %}{% macro inner() %}[{{ caller() }}]{% endmacro %}{% call outer() %}{% call inner() %}x{% endcall %}{% endcall %}`, m{}, "([x])"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestMacroErrors(t *testing.T) {
+	e := NewEnvironment()
+	testRenderErrors(t, e, []string{
+		`{% macro m(a) %}{% endmacro %}{{ m(1, a=2) }}`,
+		`{% macro m(a) %}{{ a + 1 }}{% endmacro %}{{ m("x") }}`,
+		`{% macro m() %}{{ caller() }}{% endmacro %}{{ m() }}`,
+		`{% call missing() %}x{% endcall %}`,
+		`{% macro m(a) %}{{ a }}{% endmacro %}{{ m(1, 2) }}`,
+		`{% macro m(a) %}{{ varargs }}{% endmacro %}{{ m(1, b=2) }}`,
+		`{% macro m(a) %}{{ kwargs }}{% endmacro %}{{ m(1, 2) }}`,
+		`{% macro m() %}{{ caller(1) }}{% endmacro %}{% call m() %}x{% endcall %}`,
+	}, m{})
+}
+
+func TestInclude(t *testing.T) {
+	e := NewEnvironment()
+	e.Loader = MapLoader{
+		"nav.html":     `<nav>{{ title }}</nav>`,
+		"item.html":    `<li>{{ item }}</li>`,
+		"set.html":     `{% set title = "inner" %}{{ title }}`,
+		"globals.html": `{{ title }}|{{ site }}`,
+		"child.html":   `{% extends "nav.html" %}`,
+		"cycle.html":   `{% include "loop.html" %}`,
+		"loop.html":    `{% include "cycle.html" %}`,
+		"tree.html":    `<li>{{ node.name }}{% if node.children is defined %}<ul>{% for node in node.children %}{% include "tree.html" %}{% endfor %}</ul>{% endif %}</li>`,
+		"broken.html":  `{% if %}`,
+	}
+	e.Globals["site"] = "example"
+	fixtures := []evalFixture{
+		{"Include", `{% include "nav.html" %}`, m{"title": "Home"}, "<nav>Home</nav>"},
+		{"Expression", `{% include name %}`, m{"title": "Home", "name": "nav.html"}, "<nav>Home</nav>"},
+		{"Loop Context", `{% for item in [1, 2] %}{% include "item.html" %}{% endfor %}`, m{}, "<li>1</li><li>2</li>"},
+		{"Set Context", `{% set title = "Set" %}{% include "nav.html" %}`, m{}, "<nav>Set</nav>"},
+		{"Scope", `{% include "set.html" %}|{{ title }}`, m{"title": "outer"}, "inner|outer"},
+		{"Candidates", `{% include ["missing.html", "nav.html"] %}`, m{"title": "Home"}, "<nav>Home</nav>"},
+		{"Ignore Missing", `[{% include "missing.html" ignore missing %}][{% include ["a", "b"] ignore missing %}]`, m{}, "[][]"},
+		{"With Context", `{% include "globals.html" with context %}`, m{"title": "Home"}, "Home|example"},
+		{"Without Context", `{% include "globals.html" without context %}`, m{"title": "Home"}, "|example"},
+		{"Extends", `{% include "child.html" %}`, m{"title": "Home"}, "<nav>Home</nav>"},
+		{"Twice", `{% include "nav.html" %}{% include "nav.html" %}`, m{"title": "x"}, "<nav>x</nav><nav>x</nav>"},
+		{"Recursive", `{% include "tree.html" %}`, m{"node": m{"name": "a", "children": []m{
+			{"name": "b", "children": []m{{"name": "c"}}},
+			{"name": "d"},
+		}}}, "<li>a<ul><li>b<ul><li>c</li></ul></li><li>d</li></ul></li>"},
+	}
+	testFixtures(t, e, fixtures)
+
+	testRenderErrors(t, e, []string{
+		`{% include "missing.html" %}`,
+		`{% include ["a.html", "b.html"] %}`,
+		`{% include "broken.html" ignore missing %}`,
+		`{% include 1 %}`,
+	}, m{})
+
+	// unconditional recursion is stopped by the depth limit
+	tpl, err := e.Load("cycle.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpl.Render(m{}); !IsLimit(err) {
+		t.Errorf("expected a depth limit error, got %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	e := NewEnvironment()
+	e.Loader = MapLoader{
+		"forms.html":   `{% set _n = count() %}{% set version = "1" %}{% set _private = 1 %}{% macro input(name, type="text") %}<input type="{{ type }}" name="{{ name }}">{% endmacro %}{% macro textarea(name) %}<textarea name="{{ name }}"></textarea>{% endmacro %}ignored output`,
+		"context.html": `{% macro greet() %}Hi {{ name }}{% endmacro %}`,
+		"nested.html":  `{% from "forms.html" import input %}{% macro field(name) %}<p>{{ input(name) }}</p>{% endmacro %}`,
+		"base.html":    `{% block body %}{% endblock %}`,
+		"child.html":   `{% extends "base.html" %}{% import "forms.html" as forms %}{% block body %}{{ forms.input("q") }}{% endblock %}`,
+		"cycle.html":   `{% import "cycle.html" as self %}`,
+	}
+	calls := 0
+	e.Globals["count"] = func() int { calls++; return calls }
+	fixtures := []evalFixture{
+		{"Import", `{% import "forms.html" as forms %}{{ forms.input("user") }}{{ forms.textarea("bio") }} {{ forms.version }}`, m{},
+			`<input type="text" name="user"><textarea name="bio"></textarea> 1`},
+		{"Private", `{% import "forms.html" as forms %}{{ forms._private is defined }} {{ forms.missing is defined }}`, m{}, "false false"},
+		{"From", `{% from "forms.html" import input as field, textarea %}{{ field("a", type="email") }}{{ textarea("b") }}`, m{},
+			`<input type="email" name="a"><textarea name="b"></textarea>`},
+		{"Nested", `{% from "nested.html" import field %}{{ field("x") }}`, m{}, `<p><input type="text" name="x"></p>`},
+		{"Without Context", `{% import "context.html" as c %}[{{ c.greet() }}]`, m{"name": "Ann"}, "[Hi ]"},
+		{"With Context", `{% import "context.html" as c with context %}[{{ c.greet() }}]`, m{"name": "Ann"}, "[Hi Ann]"},
+		{"From With Context", `{% set name = "Bob" %}{% from "context.html" import greet with context %}[{{ greet() }}]`, m{}, "[Hi Bob]"},
+		{"Scope", `{% for i in [1] %}{% import "forms.html" as forms %}{% endfor %}{{ forms is defined }}`, m{}, "false"},
+	}
+	testFixtures(t, e, fixtures)
+
+	tpl, err := e.Load("child.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := tpl.Render(m{}); err != nil || out != `<input type="text" name="q">` {
+		t.Errorf("child.html: unexpected output %q (%v)", out, err)
+	}
+	// forms.html is only executed the first time it is imported
+	if calls != 1 {
+		t.Errorf("expected forms.html to be executed once, was executed %d times", calls)
+	}
+
+	testRenderErrors(t, e, []string{
+		`{% import "missing.html" as m %}`,
+		`{% from "forms.html" import nope %}`,
+		`{% from "forms.html" import _private %}`,
+	}, m{})
+
+	// the cycle is found, and located, in cycle.html
+	tpl, err = e.ParseString(`{% import "cycle.html" as c %}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.Render(m{}); err == nil || !strings.Contains(err.Error(), "import cycle") {
+		t.Errorf("expected an import cycle error, got %v", err)
+	}
+}
+
+func TestWhitespaceControl(t *testing.T) {
+	items := m{"items": []string{"a", "b"}}
+	fixtures := []evalFixture{
+		{"Strip", "<ul>\n  {%- for x in items %}\n  <li>{{ x }}</li>\n  {%- endfor %}\n</ul>", items, "<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>"},
+		{"Strip Both", "a  {{- 1 -}}  b {#- comment -#}\n c", m{}, "a1bc"},
+		{"No Trim", "{% if true %}\nyes\n{% endif %}\n", m{}, "\nyes\n\n"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	e := NewEnvironment()
+	e.TrimBlocks = true
+	e.LstripBlocks = true
+	fixtures = []evalFixture{
+		{"Trim Lstrip", "<ul>\n  {% for x in items %}\n  <li>{{ x }}</li>\n  {% endfor %}\n</ul>", items, "<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>"},
+		{"YAML", "list:\n{% for x in items %}\n  - {{ x }}\n{% endfor %}\n", items, "list:\n  - a\n  - b\n"},
+		{"Variables", "  {{ 1 }}\n", m{}, "  1\n"},
+		{"Not Line Start", "x {% if true %}\ny{% endif %}", m{}, "x y"},
+		{"Comment", "a\n  {# comment #}\nb", m{}, "a\nb"},
+		{"Plus", "  {%+ if true +%}\nx{% endif %}", m{}, "  \nx"},
+		{"CRLF", "{% if true %}\r\nx{% endif %}", m{}, "x"},
+	}
+	testFixtures(t, e, fixtures)
+}
+
+func TestRaw(t *testing.T) {
+	fixtures := []evalFixture{
+		{"Raw", `{% raw %}{{ name }} {% if x %}{# c #}{% endraw %}`, m{"name": "x"}, `{{ name }} {% if x %}{# c #}`},
+		{"Surrounding", `{{ a }}{%raw%}{{ a }}{%endraw%}{{ a }}`, m{"a": 1}, `1{{ a }}1`},
+		{"Empty", `[{% raw %}{% endraw %}]`, m{}, `[]`},
+		{"Helm", `{% raw %}{{ .Values.image }}:{{ .Values.tag | default "latest" }}{% endraw %}`, m{}, `{{ .Values.image }}:{{ .Values.tag | default "latest" }}`},
+		{"Not Endraw", `{% raw %}{% endrawx %}{% endraw %}`, m{}, `{% endrawx %}`},
+		{"In Block", `{% if true %}{% raw %}{% endif %}{% endraw %}{% endif %}`, m{}, `{% endif %}`},
+		{"Whitespace Control", "a {%- raw -%} \n {{ x }} \n {%- endraw -%} b", m{}, `a{{ x }}b`},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	e := NewEnvironment()
+	e.TrimBlocks = true
+	e.LstripBlocks = true
+	testFixtures(t, e, []evalFixture{
+		{"Trim", "  {% raw %}\n{{ x }}\n  {% endraw %}\ny", m{}, "{{ x }}\ny"},
+	})
+
+	if _, err := NewEnvironment().ParseString(`{% raw %}{{ x }}`, "test", "test"); err == nil {
+		t.Error("expected an error for an unclosed raw block")
+	}
+}
+
+type safeLink string
+
+func (l safeLink) Safe() Markup { return Markup(`<a href="` + string(l) + `">link</a>`) }
+
+func TestAutoEscape(t *testing.T) {
+	e := NewEnvironment()
+	e.AutoEscape = true
+	s := `<b>"Tom" & 'Jerry'</b>`
+	fixtures := []evalFixture{
+		{"Escape", `{{ s }}|{{ s|upper }}|{{ 1 }}`, m{"s": s}, `&lt;b&gt;&#34;Tom&#34; &amp; &#39;Jerry&#39;&lt;/b&gt;|&lt;B&gt;&#34;TOM&#34; &amp; &#39;JERRY&#39;&lt;/B&gt;|1`},
+		{"Text", `<p>{{ "<" }}</p>`, m{}, `<p>&lt;</p>`},
+		{"Safe", `{{ s|safe }}{{ m }}{{ l }}`, m{"s": "<i>", "m": Markup("<b>"), "l": safeLink("/")}, `<i><b><a href="/">link</a>`},
+		{"No Double Escape", `{{ s|e }}{{ s|e|e }}`, m{"s": "&"}, `&amp;&amp;`},
+		{"Concat", `{{ m ~ s }}{{ m + s }}{{ s ~ s }}`, m{"m": Markup("<b>"), "s": "<"}, `<b>&lt;<b>&lt;&lt;&lt;`},
+		{"Join", `{{ l|join(", ") }}|{{ ["<", none]|join(m) }}|{{ ["<", "&"]|join }}`, m{"l": []interface{}{Markup("<b>"), "<"}, "m": Markup("<br>")},
+			`<b>, &lt;|&lt;<br>|&lt;&amp;`},
+		{"Set Block", `{% set x %}<b>{{ s }}</b>{% endset %}{{ x }}`, m{"s": "<"}, `<b>&lt;</b>`},
+		{"Macro", `{% macro b(s) %}<b>{{ s }}</b>{% endmacro %}{{ b("<") }}`, m{}, `<b>&lt;</b>`},
+		{"Filter Block", `{% filter upper %}<b>{{ s }}</b>{% endfilter %}`, m{"s": "<"}, `<B>&LT;</B>`},
+		{"Autoescape Block", `{% autoescape false %}{{ s }}{% endautoescape %}{{ s }}`, m{"s": "<"}, `<&lt;`},
+		{"Escaped Test", `{{ m is escaped }}{{ s is escaped }}{{ s|e is escaped }}`, m{"m": Markup(""), "s": ""}, `truefalsetrue`},
+		{"Markup String", `{{ m|length }}{{ m is string }}{{ m == "<b>" }}`, m{"m": Markup("<b>")}, `3truetrue`},
+		{"xmlattr", `<a{{ d|xmlattr }}>`, m{"d": m{"href": "/?a=1&b=2"}}, `<a href="/?a=1&amp;b=2">`},
+	}
+	testFixtures(t, e, fixtures)
+
+	testFixtures(t, NewEnvironment(), []evalFixture{
+		{"Off", `{{ s }}{{ s|e }}`, m{"s": "<"}, `<&lt;`},
+		{"Autoescape Block", `{% autoescape true %}{{ s }}{% endautoescape %}{{ s }}`, m{"s": "<"}, `&lt;<`},
+	})
+
+	e = NewEnvironment()
+	e.AutoEscapeFunc = AutoEscapeExtensions(".html", ".xml")
+	for name, result := range map[string]string{"page.html": "&lt;", "feed.xml": "&lt;", "mail.txt": "<"} {
+		tpl, err := e.ParseString(`{{ s }}`, name, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := tpl.Render(m{"s": "<"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != result {
+			t.Errorf("%s: expected %q, got %q", name, result, out)
+		}
+	}
+}
+
+func TestContextualEscape(t *testing.T) {
+	e := NewEnvironment()
+	e.AutoEscape = true
+	e.ContextualEscape = true
+	c := m{"s": `"it's" <b> & </script>`, "url": "javascript:alert(1)", "q": "a b&c/d", "l": []interface{}{1, "x"}, "j": "1; alert(document.cookie)"}
+	fixtures := []evalFixture{
+		{"Text", `<p>{{ s }}</p>`, c, `<p>&#34;it&#39;s&#34; &lt;b&gt; &amp; &lt;/script&gt;</p>`},
+		{"Attribute", `<p title="{{ s }}" class='{{ s }}'>`, c, `<p title="&#34;it&#39;s&#34; &lt;b&gt; &amp; &lt;/script&gt;" class='&#34;it&#39;s&#34; &lt;b&gt; &amp; &lt;/script&gt;'>`},
+		{"Unquoted Attribute", `<p title={{ "a b" }} id=x{{ "=y" }}>`, c, `<p title=a&#32;b id=x&#61;y>`},
+		{"Attribute Name", `<input {{ "checked" }} {{ "onclick" }} {{ "a=b" }}>`, c, `<input checked ZjigoZ ZjigoZ>`},
+		{"URL Scheme", `<a href="{{ url }}">{{ url }}</a><a href="{{ "HTTPS://x.org/a b" }}">`, c, `<a href="#ZjigoZ">javascript:alert(1)</a><a href="HTTPS://x.org/a%20b">`},
+		{"URL Query", `<a href="/search?q={{ q }}#{{ q }}">`, c, `<a href="/search?q=a%20b%26c%2Fd#a%20b%26c%2Fd">`},
+		{"URL Path", `<img src="/img/{{ q }}">`, c, `<img src="/img/a%20b&amp;c/d">`},
+		{"Script Value", `<script>var s = {{ s }}, l = {{ l }};</script>`, c, `<script>var s = "\"it's\" \u003cb\u003e \u0026 \u003c/script\u003e", l = [1,"x"];</script>`},
+		{"Script String", "<script>var s = '{{ s }}', t = `{{ t }}`;</script>{{ s }}", m{"s": c["s"], "t": "${x}\n"}, `<script>var s = '\u0022it\u0027s\u0022 \u003Cb\u003E \u0026 \u003C/script\u003E', t = ` + "`\\u0024{x}\\n`" + `;</script>&#34;it&#39;s&#34; &lt;b&gt; &amp; &lt;/script&gt;`},
+		{"Script Comment", "<script>// {{ s }}\nx = {{ 1 }} /* {{ s }} */</script>", c, "<script>// \nx = 1 /*  */</script>"},
+		{"Event Handler", `<button onclick="go({{ s }})">`, c, `<button onclick="go(&#34;\&#34;it&#39;s\&#34; \u003cb\u003e \u0026 \u003c/script\u003e&#34;)">`},
+		{"Style", `<style>p { color: {{ "red" }}; } p { color: {{ "}*{x:expression(1)" }}; font: '{{ "a b" }}' }</style>`, c, `<style>p { color: red; } p { color: ZjigoZ; font: 'a\20 b' }</style>`},
+		{"Style Attribute", `<p style="color: {{ "#fff" }}; background: {{ "url(x)" }}">`, c, `<p style="color: #fff; background: ZjigoZ">`},
+		{"Comment", `<!-- <script> -->{{ "<" }}`, c, `<!-- <script> -->&lt;`},
+		{"Safe", `<p>{{ "<b>"|safe }}</p><script>var b = {{ "<b>x</b> &amp; y"|safe }};</script>`, c, `<p><b></p><script>var b = "x \u0026 y";</script>`},
+		{"Escaped Script", `<script>var n = {{ j|e }};</script>`, c, `<script>var n = "1; alert(document.cookie)";</script>`},
+		{"Set Block Script", `{% set x %}{{ j }}{% endset %}<script>var n = {{ x }};</script>`, c, `<script>var n = "1; alert(document.cookie)";</script>`},
+		{"Macro Script", `{% macro m(v) %}{{ v }}{% endmacro %}<script>var n = {{ m(j) }};</script>`, c, `<script>var n = "1; alert(document.cookie)";</script>`},
+		{"Macro URL", `{% macro link(u) %}{{ u }}{% endmacro %}<a href="{{ link(url) }}">{{ link(url) }}</a>`, c, `<a href="#ZjigoZ">javascript:alert(1)</a>`},
+		{"Set Block URL", `{% set x %}{{ url }}{% endset %}<a href="{{ x }}">`, c, `<a href="#ZjigoZ">`},
+		{"Xmlattr", `<a{{ d|xmlattr }}><p title="{{ d|xmlattr }}">`, m{"d": m{"id": "x"}}, `<a id="x"><p title=" id=&#34;x&#34;">`},
+		{"Split Tag", `<a {{ "id" }}="{{ "x" }}" href="{{ "/" }}{{ url }}">`, c, `<a id="x" href="/javascript:alert(1)">`},
+		{"Set Block", `<script>{% set x %}var a = {{ "b" }};{% endset %}{{ x }}</script>`, c, `<script>var a = "b";</script>`},
+		{"Set Block Loop", `<script>{% for i in [1, 2] %}{% set x %}var a{{ i }} = {{ i }};{% endset %}{{ x }}{% endfor %}</script>`, c, `<script>var a1 = 1;var a2 = 2;</script>`},
+		{"Set Block Twice", `<script>{% set x %}var a = {{ "b" }};{% endset %}{{ x }}{{ x }}</script>`, c, `<script>var a = "b";"var a = \"b\";"</script>`},
+		{"Autoescape Off", `<script>{% autoescape false %}{{ "<" }}{% endautoescape %}{{ "<" }}</script>`, c, `<script><"\u003c"</script>`},
+	}
+	testFixtures(t, e, fixtures)
+}
+
+// failWriter fails every write after the first n bytes.
+type failWriter struct {
+	n   int
+	err error
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, w.err
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestExecute(t *testing.T) {
+	e := NewEnvironment()
+	e.Loader = MapLoader{"inc.html": `[{{ x }}]`}
+	tpl, err := e.ParseString(`{% for i in l %}{{ i }},{% endfor %}{% include "inc.html" %}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	if err := tpl.Execute(b, m{"l": []int{1, 2, 3}, "x": "y"}); err != nil {
+		t.Fatal(err)
+	}
+	if out := b.String(); out != "1,2,3,[y]" {
+		t.Errorf("expected %q, got %q", "1,2,3,[y]", out)
+	}
+
+	// write errors stop rendering
+	calls := 0
+	count := func() int { calls++; return calls }
+	tpl, err = e.ParseString(`{% for i in l %}{{ count() }},{% endfor %}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &failWriter{n: 3, err: errors.New("broken pipe")}
+	err = tpl.Execute(w, m{"l": make([]int, 100), "count": count})
+	if err != w.err {
+		t.Errorf("expected %v, got %v", w.err, err)
+	}
+	if calls != 2 {
+		t.Errorf("expected rendering to stop after 2 calls, got %d", calls)
+	}
+
+	if err := tpl.Execute(b, 1); err == nil {
+		t.Error("expected an error for a bad context")
+	}
+
+	// loops over channels write each item before receiving the next
+	tpl, err = e.ParseString(`{% for x in ch %}{{ x }}{% endfor %}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, out := make(chan string), make(chanWriter)
+	done := make(chan error)
+	go func() { done <- tpl.Execute(out, m{"ch": ch}) }()
+	for _, x := range []string{"a", "b"} {
+		ch <- x
+		if s := <-out; s != x {
+			t.Errorf("expected %q to be written, got %q", x, s)
+		}
+	}
+	close(ch)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// chanWriter sends everything written to it on the channel.
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestLimits(t *testing.T) {
+	render := func(e *Environment, source string, data m) (string, error) {
+		tpl, err := e.ParseString(source, "test", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tpl.Render(data)
+	}
+	limit := func(err error, name string) {
+		t.Helper()
+		var le *LimitError
+		if !errors.As(err, &le) || le.Limit != name {
+			t.Errorf("expected %s to be exceeded, got %v", name, err)
+		}
+	}
+
+	e := NewEnvironment()
+	e.MaxIterations = 50
+	l := make([]int, 10)
+	_, err := render(e, `{% for i in l %}{% for j in l %}{% endfor %}{% endfor %}`, m{"l": l})
+	limit(err, "MaxIterations")
+	if _, err := render(e, `{% for i in l %}{% for j in l[:4] %}{% endfor %}{% endfor %}`, m{"l": l}); err != nil {
+		t.Error(err)
+	}
+
+	e = NewEnvironment()
+	e.MaxOutput = 10
+	out, err := render(e, `{% for i in l %}{{ i }}{{ i }}{% endfor %}`, m{"l": l})
+	limit(err, "MaxOutput")
+	if len(out) > 10 {
+		t.Errorf("expected at most 10 bytes of output, got %q", out)
+	}
+	// output which is never written is limited too
+	for _, source := range []string{
+		`{{ "x"|center(50000000)|length }}`,
+		`{{ "a\nb"|indent(50000000)|length }}`,
+		`{{ "a b c d e f"|wordwrap(1, wrapstring="0123456789")|length }}`,
+		`{{ [1]|tojson(50000000)|length }}`,
+		`{% set x %}{% for i in l %}{{ i }}{{ i }}{% endfor %}{% endset %}{{ x|length }}`,
+		`{% macro m() %}{% for i in l %}{{ i }}{{ i }}{% endfor %}{% endmacro %}{{ m()|length }}`,
+	} {
+		_, err := render(e, source, m{"l": l})
+		limit(err, "MaxOutput")
+	}
+	if out, err := render(e, `{{ "x"|center(5) }}{{ "a b"|wordwrap(1) }}`, m{}); err != nil || out != "  x  a\nb" {
+		t.Errorf("expected output within the limit, got %q, %v", out, err)
+	}
+
+	e = NewEnvironment()
+	e.MaxDepth = 10
+	e.Loader = MapLoader{"a": `{% include "b" %}`, "b": `{{ f(0) }}`}
+	_, err = render(e, `{% macro f(n) %}{{ f(n + 1) }}{% endmacro %}{{ f(0) }}`, m{})
+	limit(err, "MaxDepth")
+	_, err = render(e, `{% macro f(n) %}{% if n < 9 %}{% include "a" %}{% endif %}{% endmacro %}{{ f(0) }}`, m{})
+	limit(err, "MaxDepth")
+	if !IsLimit(err) {
+		t.Errorf("expected IsLimit(%v)", err)
+	}
+	// recursion is limited even if MaxDepth is not set
+	_, err = render(NewEnvironment(), `{% macro f(n) %}{{ f(n) }}{% endmacro %}{{ f(1) }}`, m{})
+	limit(err, "MaxDepth")
+
+	e = NewEnvironment()
+	e.Timeout = 10 * time.Millisecond
+	sleep := func() string { time.Sleep(time.Millisecond); return "" }
+	_, err = render(e, `{% for i in l %}{{ sleep() }}{% endfor %}`, m{"l": make([]int, 1000), "sleep": sleep})
+	limit(err, "Timeout")
+
+	// channels which are never closed are received from as the loop runs
+	_, err = render(e, `{% for i in ch %}{% endfor %}`, m{"ch": make(chan int)})
+	limit(err, "Timeout")
+	e = NewEnvironment()
+	e.MaxIterations = 10
+	ch := make(chan int, 20)
+	for i := 0; i < 20; i++ {
+		ch <- i
+	}
+	_, err = render(e, `{% for i in ch %}{% endfor %}`, m{"ch": ch})
+	limit(err, "MaxIterations")
+}
+
+func TestRenderContext(t *testing.T) {
+	e := NewEnvironment()
+	e.Loader = MapLoader{"macros": `{% macro m() %}{% for i in [1, 2] %}{{ i }}{% endfor %}{% endmacro %}`}
+	tpl, err := e.ParseString(`{% from "macros" import m %}{% for i in l %}{{ stop(i) }}{{ m() }}{% endfor %}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	stop := func(i int) string {
+		if calls++; i == 2 {
+			cancel()
+		}
+		return ""
+	}
+	out, err := tpl.RenderContext(ctx, m{"l": []int{0, 1, 2, 3, 4}, "stop": stop})
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if calls != 3 || out != "1212" {
+		t.Errorf("expected rendering to stop after 3 iterations, got %d calls and %q", calls, out)
+	}
+
+	// the macro was imported by the cancelled render, but may still be used
+	out, err = tpl.Render(m{"l": []int{0}, "stop": func(int) string { return "" }})
+	if err != nil || out != "12" {
+		t.Errorf("expected %q, got %q, %v", "12", out, err)
+	}
+
+	if _, err := tpl.RenderContext(ctx, m{}); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	tpl, err = e.ParseString(`{% for x in ch %}{% endfor %}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := tpl.RenderContext(ctx, m{"ch": make(chan int)}); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+type customer struct {
+	Name     string
+	Password string
+	Owner    *customer
+	Greet    func() string
+}
+
+func (a *customer) Title() string  { return "Dear " + a.Name }
+func (a *customer) Delete() string { return "deleted" }
+
+func TestSandbox(t *testing.T) {
+	e := NewSandboxedEnvironment()
+	e.Sandbox = &SandboxPolicy{
+		Methods:     []string{"jigo.customer.Title"},
+		DeniedNames: []string{"Password"},
+	}
+	e.Globals["shout"] = strings.ToUpper
+	a := &customer{Name: "ann", Password: "secret", Greet: func() string { return "hi" }}
+	a.Owner = &customer{Name: "bob", Password: "hunter2"}
+	c := m{"a": a}
+	fixtures := []evalFixture{
+		{"Fields", `{{ a.Name }} {{ a.Owner.Name }} {{ a["Name"] }}`, c, "ann bob ann"},
+		{"Allowed Method", `{{ a.Title() }} {{ a.Owner.Title() }}`, c, "Dear ann Dear bob"},
+		{"Globals", `{{ shout(a.Name) }} {{ namespace(x=1).x }}`, c, "ANN 1"},
+		{"Macros", `{% macro m(x) %}<{{ x }}>{% endmacro %}{{ m(a.Name) }}{% call m(1) %}{% endcall %}`, c, "<ann><1>"},
+		{"Filter Attribute", `{{ [a]|map(attribute="Name")|join }} {{ [a]|sort(attribute="Name")|length }}`, c, "ann 1"},
+		{"Printable", `{{ [1, a.Name]|tojson }} {{ [a]|join(",", "Name") }}`, c, `[1,"ann"] ann`},
+		{"Builtins", `{% for x in [1, 2, 3] %}{{ loop.cycle("a", "b") }}{% endfor %}`, c, "aba"},
+		{"Super", `{% extends "base.html" %}{% block b %}[{{ super() }}]{% endblock %}`, c, "[base]"},
+	}
+	e.Loader = MapLoader{"base.html": `{% block b %}base{% endblock %}`}
+	testFixtures(t, e, fixtures)
+
+	tpl, err := e.ParseString(`{{ Title() }} {{ Name }}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := tpl.Render(a); err != nil || out != "Dear ann ann" {
+		t.Errorf("expected %q, got %q, %v", "Dear ann ann", out, err)
+	}
+
+	for _, source := range []string{
+		`{{ a.Password }}`,
+		`{{ a.Owner.Password }}`,
+		`{{ a["Password"] }}`,
+		`{{ a.Delete() }}`,
+		`{{ a.Greet() }}`,
+		`{{ f() }}`,
+		`{% call f() %}{% endcall %}`,
+		`{% macro m() %}{{ a.Password }}{% endmacro %}{{ m() }}`,
+		`{{ a }}`,
+		`{{ [a] }}`,
+		`{{ a|string }}`,
+		`{{ "%+v"|format(a) }}`,
+		`{{ a|tojson }}`,
+		`{{ a ~ "" }}`,
+		`{{ [a]|join }}`,
+		`{{ [a]|map("upper")|first }}`,
+		`{{ {a: 1} }}`,
+		`{{ [a]|map(attribute="Password")|list }}`,
+		`{{ [a]|map(attribute="Owner.Password")|list }}`,
+		`{{ [a]|selectattr("Password")|list }}`,
+		`{{ [a]|rejectattr("Password", "none")|list }}`,
+		`{{ [a, a]|sort(attribute="Password")|length }}`,
+		`{{ [a]|groupby("Password")|length }}`,
+		`{{ [a]|sum(attribute="Password") }}`,
+		`{{ [a]|join(",", "Password") }}`,
+		`{{ [a, a]|unique(attribute="Password")|length }}`,
+		`{{ [a, a]|max(attribute="Password") }}`,
+	} {
+		tpl, err := e.ParseString(source, "test", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tpl.Render(m{"a": a, "f": strings.TrimSpace})
+		var se *SecurityError
+		if !errors.As(err, &se) || !strings.HasPrefix(err.Error(), "template: test:1:") {
+			t.Errorf("%s: expected a security error, got %v", source, err)
+		}
+	}
+
+	tpl, err = e.ParseString(`{{ Password }}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.Render(a); !IsSecurity(err) {
+		t.Errorf("expected a security error, got %v", err)
+	}
+
+	// the same template is not restricted outside of a sandbox
+	e = NewEnvironment()
+	testFixtures(t, e, []evalFixture{
+		{"Unsandboxed", `{{ a.Password }} {{ a.Delete() }} {{ a.Greet() }}`, c, "secret deleted hi"},
+	})
+}
+
+func TestUndefined(t *testing.T) {
+	e := NewEnvironment()
+	c := m{"d": m{}, "n": 1, "f": func(v interface{}) string { return "got" }}
+	testFixtures(t, e, []evalFixture{
+		{"Default", `{{ missing }}|{{ d.x }}|{{ missing ~ "a" }}|{{ missing|default("b") }}|{{ missing is defined }}`, c, "||a|b|false"},
+		{"Conditions", `{% if missing %}a{% elif d.x or not missing %}b{% endif %}|{{ missing and f() }}`, c, "b|false"},
+	})
+	testRenderErrors(t, e, []string{
+		`{{ missing + 1 }}`,
+		`{{ -missing }}`,
+		`{{ missing.x }}`,
+		`{{ missing[0] }}`,
+		`{{ "a"|replace(missing, "b") }}`,
+	}, c)
+
+	e.Undefined = ChainableUndefined
+	testFixtures(t, e, []evalFixture{
+		{"Chainable", `{{ missing.x.y }}|{{ d.x.y }}|{{ missing[0][1:] }}|{{ missing.x is defined }}|{{ d.x.y|default("a") }}`, c, "|||false|a"},
+	})
+
+	e.Undefined = DebugUndefined
+	testFixtures(t, e, []evalFixture{
+		{"Debug", `Hi {{ name }}, {{ d.x }}{{ d["y"] }}{{ n }}`, c, `Hi {{ name }}, {{ d.x }}{{ d["y"] }}1`},
+	})
+
+	e.Undefined = StrictUndefined
+	testFixtures(t, e, []evalFixture{
+		{"Strict", `{{ missing is defined }}|{{ missing|default("a") }}|{{ d.x is undefined }}`, c, "false|a|true"},
+	})
+	testRenderErrors(t, e, []string{
+		`{{ missing }}`,
+		`{{ d.x }}`,
+		`{{ missing ~ "a" }}`,
+		`{{ missing == 1 }}`,
+		`{{ missing|upper }}`,
+		`{% for x in missing %}{% endfor %}`,
+		`{{ f(missing) }}`,
+		`{{ f(x=missing) }}`,
+		`{% set x = missing %}`,
+		`{{ "a"|replace(missing, "b") }}`,
+		`{{ 1 is sameas(missing) }}`,
+		`{% if missing %}{% endif %}`,
+		`{{ true and d.x }}`,
+		`{{ not missing }}`,
+	}, c)
+
+	// errors name the value which was undefined
+	tpl, err := e.ParseString(`{{ f(user.name) }}`, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.Render(c); err == nil || !strings.HasSuffix(err.Error(), ": user is undefined") {
+		t.Errorf("expected user to be undefined, got %v", err)
+	}
+}
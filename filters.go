@@ -0,0 +1,1148 @@
+package jigo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This file contains the builtin filters, which match the builtin filters
+// of Jinja2.  Filters take their optional parameters either by position or
+// by keyword, so most accept Args and Kwargs and bind them with params.
+
+// builtinFilters returns the default filters for the environment e.  Filters
+// like map and select which call other filters or tests look them up in e
+// when they are called, and filters which take an attribute argument look it
+// up subject to e's Sandbox.
+func builtinFilters(e *Environment) map[string]interface{} {
+	return map[string]interface{}{
+		"abs":        filterAbs,
+		"batch":      filterBatch,
+		"capitalize": filterCapitalize,
+		"center":     e.filterCenter,
+		"d":          filterDefault,
+		"default":    filterDefault,
+		"dictsort":   e.filterDictsort,
+		"e":          filterEscape,
+		"escape":     filterEscape,
+		"first":      filterFirst,
+		"float":      filterFloat,
+		"format":     filterFormat,
+		"groupby":    e.filterGroupby,
+		"indent":     e.filterIndent,
+		"int":        filterInt,
+		"join":       e.filterJoin,
+		"last":       filterLast,
+		"length":     filterLength,
+		"list":       filterList,
+		"lower":      filterLower,
+		"map":        e.filterMap,
+		"max":        e.filterMax,
+		"min":        e.filterMin,
+		"reject":     e.filterReject,
+		"rejectattr": e.filterRejectattr,
+		"replace":    filterReplace,
+		"reverse":    e.filterReverse,
+		"round":      filterRound,
+		"safe":       filterSafe,
+		"select":     e.filterSelect,
+		"selectattr": e.filterSelectattr,
+		"slice":      filterSlice,
+		"sort":       e.filterSort,
+		"string":     filterString,
+		"striptags":  filterStriptags,
+		"sum":        e.filterSum,
+		"title":      filterTitle,
+		"tojson":     e.filterTojson,
+		"trim":       filterTrim,
+		"truncate":   filterTruncate,
+		"unique":     e.filterUnique,
+		"upper":      filterUpper,
+		"urlencode":  filterUrlencode,
+		"wordcount":  filterWordcount,
+		"wordwrap":   e.filterWordwrap,
+		"xmlattr":    filterXmlattr,
+	}
+}
+
+// filter calls the filter called name with v and any extra arguments.  In a
+// sandbox, filters which print their arguments may only be passed values
+// which the sandbox allows to be printed.
+func (e *Environment) filter(name string, v interface{}, args []interface{}, kwargs map[string]interface{}) (interface{}, error) {
+	fn, ok := e.Filters[name]
+	if !ok {
+		return nil, fmt.Errorf("no filter named %q", name)
+	}
+	args = append([]interface{}{v}, args...)
+	if printingFilters[name] {
+		if err := e.printable(name == "tojson", args...); err != nil {
+			return nil, err
+		}
+	}
+	return callFunc(fn, args, kwargs)
+}
+
+// params binds the optional parameters of a filter, passed either by
+// position or by keyword, to names.  Parameters which were not passed are nil.
+func params(args Args, kwargs Kwargs, names ...string) ([]interface{}, error) {
+	if len(args) > len(names) {
+		return nil, fmt.Errorf("too many arguments: want at most %d, got %d", len(names), len(args))
+	}
+	p := make([]interface{}, len(names))
+	copy(p, args)
+	for name, v := range kwargs {
+		i := 0
+		for i < len(names) && names[i] != name {
+			i++
+		}
+		if i == len(names) {
+			return nil, fmt.Errorf("unexpected keyword argument %q", name)
+		}
+		if i < len(args) {
+			return nil, fmt.Errorf("multiple values for argument %q", name)
+		}
+		p[i] = v
+	}
+	return p, nil
+}
+
+// intParam returns the integer parameter p, or def if it was not passed.
+func intParam(p interface{}, def int) (int, error) {
+	if p == nil {
+		return def, nil
+	}
+	if typeOf(p) != intType {
+		return 0, fmt.Errorf("expected an integer, got %T", p)
+	}
+	i, _ := asInteger(p)
+	return int(i), nil
+}
+
+// boolParam returns the truth of parameter p, or def if it was not passed.
+func boolParam(p interface{}, def bool) bool {
+	if p == nil {
+		return def
+	}
+	return truthy(p)
+}
+
+// stringParam returns parameter p as a string, or def if it was not passed.
+func stringParam(p interface{}, def string) string {
+	if p == nil {
+		return def
+	}
+	return asString(p)
+}
+
+// checkSize returns a *LimitError if a value of n bytes, which a filter is
+// about to make, is larger than MaxOutput.  Filters whose output can be much
+// larger than their input check it, so that a template cannot allocate huge
+// strings which it then never writes.
+func (e *Environment) checkSize(n int64) error {
+	if e.MaxOutput > 0 && n > e.MaxOutput {
+		return &LimitError{"MaxOutput", e.MaxOutput}
+	}
+	return nil
+}
+
+// keepSafe returns s, the result of changing the case or whitespace of v, as
+// Markup if v is safe HTML, since those changes keep it safe.
+func keepSafe(v interface{}, s string) interface{} {
+	if _, ok := asSafe(v); ok {
+		return Markup(s)
+	}
+	return s
+}
+
+// sequence returns the items of v.  Strings are sequences of characters,
+// and everything else is iterated over as in a for loop.
+func sequence(v interface{}) ([]interface{}, error) {
+	if typeOf(v) == stringType {
+		s := asString(v)
+		items := make([]interface{}, 0, len(s))
+		for _, r := range s {
+			items = append(items, string(r))
+		}
+		return items, nil
+	}
+	return iterate(v)
+}
+
+// attribute looks up a dotted attribute path like `user.name` on v.  Parts of
+// the path which are integers index into sequences.  Attributes which e's
+// Sandbox does not allow are a *SecurityError.
+func (e *Environment) attribute(v interface{}, path string) (interface{}, bool, error) {
+	for _, name := range strings.Split(path, ".") {
+		if i, err := strconv.Atoi(name); err == nil {
+			rv := reflect.ValueOf(v)
+			if (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && i >= 0 && i < rv.Len() {
+				v = rv.Index(i).Interface()
+				continue
+			}
+		}
+		var ok bool
+		var err error
+		if v, ok, err = getattr(v, name, e.Sandbox); !ok {
+			return nil, false, err
+		}
+	}
+	return v, true, nil
+}
+
+// sortKey returns a function which returns the value items are sorted and
+// compared on:  either the item itself or one of its attributes, with
+// strings lowercased unless the comparison is case sensitive.
+func (e *Environment) sortKey(attr interface{}, caseSensitive bool) func(interface{}) (interface{}, error) {
+	return func(v interface{}) (interface{}, error) {
+		if attr != nil {
+			var err error
+			if v, _, err = e.attribute(v, asString(attr)); err != nil {
+				return nil, err
+			}
+		}
+		if s, ok := v.(string); ok && !caseSensitive {
+			return strings.ToLower(s), nil
+		}
+		return v, nil
+	}
+}
+
+// sortItems sorts items by the keys returned by key.
+func sortItems(items []interface{}, key func(interface{}) (interface{}, error), reverse bool) error {
+	var err error
+	sort.SliceStable(items, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		var a, b interface{}
+		if a, err = key(items[i]); err != nil {
+			return false
+		}
+		if b, err = key(items[j]); err != nil {
+			return false
+		}
+		c, e := compare(a, b)
+		if e != nil {
+			err = e
+		}
+		if reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+	return err
+}
+
+func filterAbs(v interface{}) (interface{}, error) {
+	switch typeOf(v) {
+	case intType:
+		i, _ := asInteger(v)
+		if i == math.MinInt64 {
+			return nil, errOverflow
+		}
+		if i < 0 {
+			return -i, nil
+		}
+		return i, nil
+	case floatType:
+		f, _ := asFloat(v)
+		return math.Abs(f), nil
+	}
+	return nil, fmt.Errorf("abs of %T", v)
+}
+
+// filterBatch batches items into lists of size items, filling out the last
+// batch with fill_with if it is passed.
+func filterBatch(v interface{}, size int, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "fill_with")
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("batch size must be positive")
+	}
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	var batches []interface{}
+	for len(items) > 0 {
+		n := size
+		if n > len(items) {
+			n = len(items)
+		}
+		batch := append([]interface{}(nil), items[:n]...)
+		for p[0] != nil && len(batch) < size {
+			batch = append(batch, p[0])
+		}
+		batches = append(batches, batch)
+		items = items[n:]
+	}
+	return batches, nil
+}
+
+func filterCapitalize(v interface{}) interface{} {
+	s := strings.ToLower(asString(v))
+	if s == "" {
+		return keepSafe(v, s)
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	return keepSafe(v, string(unicode.ToUpper(r))+s[size:])
+}
+
+// filterCenter centers a string in a field of the given width, which is 80
+// by default.
+func (e *Environment) filterCenter(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "width")
+	if err != nil {
+		return nil, err
+	}
+	width, err := intParam(p[0], 80)
+	if err != nil {
+		return nil, err
+	}
+	s := asString(v)
+	pad := width - utf8.RuneCountInString(s)
+	if pad <= 0 {
+		return s, nil
+	}
+	if err := e.checkSize(int64(len(s) + pad)); err != nil {
+		return nil, err
+	}
+	// pad the same way as python's str.center
+	left := pad/2 + (pad & width & 1)
+	return strings.Repeat(" ", left) + s + strings.Repeat(" ", pad-left), nil
+}
+
+// filterDefault returns default_value (or "") if v is undefined.  If boolean
+// is true, it is also returned if v is false in a boolean context.
+func filterDefault(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "default_value", "boolean")
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || isUndefined(v) || (boolParam(p[1], false) && !truthy(v)) {
+		if p[0] == nil {
+			return "", nil
+		}
+		return p[0], nil
+	}
+	return v, nil
+}
+
+// filterDictsort sorts a map and returns a list of its (key, value) pairs.
+// It is sorted by key unless by is "value".
+func (e *Environment) filterDictsort(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "case_sensitive", "by", "reverse")
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return nil, fmt.Errorf("dictsort of %T", v)
+	}
+	pos := 0
+	switch by := stringParam(p[1], "key"); by {
+	case "key":
+	case "value":
+		pos = 1
+	default:
+		return nil, fmt.Errorf("you can only sort by either \"key\" or \"value\"")
+	}
+	items := make([]interface{}, 0, rv.Len())
+	for _, k := range rv.MapKeys() {
+		items = append(items, []interface{}{k.Interface(), rv.MapIndex(k).Interface()})
+	}
+	key := e.sortKey(nil, boolParam(p[0], false))
+	err = sortItems(items, func(v interface{}) (interface{}, error) { return key(v.([]interface{})[pos]) }, boolParam(p[2], false))
+	return items, err
+}
+
+// filterEscape returns v as escaped HTML.  Values which are already safe
+// HTML are not escaped again.
+func filterEscape(v interface{}) Markup {
+	return escape(v)
+}
+
+func filterFirst(v interface{}) (interface{}, error) {
+	items, err := sequence(v)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// filterFloat converts v to a float, or returns default (0.0) if it cannot.
+func filterFloat(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "default")
+	if err != nil {
+		return nil, err
+	}
+	switch typeOf(v) {
+	case intType, floatType:
+		f, _ := asFloat(v)
+		return f, nil
+	case boolType:
+		if v.(bool) {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	case stringType:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(asString(v)), 64); err == nil {
+			return f, nil
+		}
+	}
+	if p[0] == nil {
+		return 0.0, nil
+	}
+	return p[0], nil
+}
+
+// filterFormat formats its arguments with v as a format string.  Go's fmt
+// verbs are used, which for common formats like %s, %d and %.2f are the same
+// as Python's.
+func filterFormat(v interface{}, args ...interface{}) string {
+	return fmt.Sprintf(asString(v), args...)
+}
+
+// filterGroupby sorts items by attribute and groups them by it.  Each group
+// has a grouper and a list of the items in that group.
+func (e *Environment) filterGroupby(v interface{}, attr string, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "default")
+	if err != nil {
+		return nil, err
+	}
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	key := func(v interface{}) (interface{}, error) {
+		if k, ok, err := e.attribute(v, attr); ok || err != nil {
+			return k, err
+		}
+		return p[0], nil
+	}
+	if err := sortItems(items, key, false); err != nil {
+		return nil, err
+	}
+	var groups []interface{}
+	for i := 0; i < len(items); {
+		k, err := key(items[i])
+		if err != nil {
+			return nil, err
+		}
+		j := i + 1
+		for j < len(items) {
+			kj, _ := key(items[j])
+			if c, _ := compare(k, kj); c != 0 {
+				break
+			}
+			j++
+		}
+		groups = append(groups, group{k, items[i:j:j]})
+		i = j
+	}
+	return groups, nil
+}
+
+// filterIndent indents each line after the first by width spaces, or by
+// width itself if it is a string.  If first is true the first line is also
+// indented, and if blank is true so are blank lines.
+func (e *Environment) filterIndent(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "width", "first", "blank")
+	if err != nil {
+		return nil, err
+	}
+	indent := "    "
+	if w, ok := p[0].(string); ok {
+		indent = w
+	} else if p[0] != nil {
+		width, err := intParam(p[0], 4)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.checkSize(int64(width)); err != nil {
+			return nil, err
+		}
+		indent = strings.Repeat(" ", width)
+	}
+	first, blank := boolParam(p[1], false), boolParam(p[2], false)
+
+	s := asString(v)
+	lines := strings.Split(s, "\n")
+	if err := e.checkSize(int64(len(s)) + int64(len(indent))*int64(len(lines))); err != nil {
+		return nil, err
+	}
+	for i, line := range lines {
+		if (i > 0 || first) && (blank || strings.TrimSpace(line) != "") {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// filterInt converts v to an integer, or returns default (0) if it cannot.
+// Strings are parsed in the given base, which defaults to 10.
+func filterInt(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "default", "base")
+	if err != nil {
+		return nil, err
+	}
+	switch typeOf(v) {
+	case intType, floatType:
+		i, _ := asInteger(v)
+		return i, nil
+	case boolType:
+		if v.(bool) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case stringType:
+		base, err := intParam(p[1], 10)
+		if err != nil {
+			return nil, err
+		}
+		s := strings.TrimSpace(asString(v))
+		if i, err := strconv.ParseInt(s, base, 64); err == nil {
+			return i, nil
+		}
+		// allow prefixes like 0x when parsing in other bases
+		if i, err := strconv.ParseInt(s, 0, 64); err == nil && base != 10 {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil && base == 10 {
+			return int64(f), nil
+		}
+	}
+	if p[0] == nil {
+		return int64(0), nil
+	}
+	return p[0], nil
+}
+
+// filterJoin joins the items of v (or their attribute) with d.  If d or any
+// of the items is safe HTML, the others are escaped and the result is Markup,
+// so that it is not escaped again.
+func (e *Environment) filterJoin(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "d", "attribute")
+	if err != nil {
+		return nil, err
+	}
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	_, safe := asSafe(p[0])
+	for i, item := range items {
+		if p[1] != nil {
+			if item, _, err = e.attribute(item, asString(p[1])); err != nil {
+				return nil, err
+			}
+		}
+		if err := e.printable(false, item); err != nil {
+			return nil, err
+		}
+		if _, ok := asSafe(item); ok {
+			safe = true
+		}
+		items[i] = item
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		if safe {
+			strs[i] = string(escape(item))
+		} else {
+			strs[i] = filterString(item)
+		}
+	}
+	if safe {
+		return Markup(strings.Join(strs, string(escape(p[0])))), nil
+	}
+	return strings.Join(strs, stringParam(p[0], "")), nil
+}
+
+func filterLast(v interface{}) (interface{}, error) {
+	items, err := sequence(v)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[len(items)-1], nil
+}
+
+// filterLength returns the number of items in a sequence or map, or the
+// number of characters in a string.
+func filterLength(v interface{}) (int, error) {
+	if v == nil || isUndefined(v) {
+		return 0, nil
+	}
+	if typeOf(v) == stringType {
+		return utf8.RuneCountInString(asString(v)), nil
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return rv.Len(), nil
+	}
+	return 0, fmt.Errorf("%T has no length", v)
+}
+
+func filterList(v interface{}) (interface{}, error) {
+	return sequence(v)
+}
+
+func filterLower(v interface{}) interface{} {
+	return keepSafe(v, strings.ToLower(asString(v)))
+}
+
+// filterMap applies a filter to each item of v, or with the attribute keyword
+// argument looks up an attribute of each item.
+func (e *Environment) filterMap(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	mapped := make([]interface{}, len(items))
+	if attr, ok := kwargs["attribute"]; ok {
+		p, err := params(args, kwargs, "attribute", "default")
+		if err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			if mapped[i], ok, err = e.attribute(item, asString(attr)); err != nil {
+				return nil, err
+			} else if !ok {
+				mapped[i] = p[1]
+			}
+		}
+		return mapped, nil
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("map requires a filter name or an attribute")
+	}
+	name := asString(args[0])
+	if _, ok := e.Filters[name]; !ok {
+		return nil, fmt.Errorf("no filter named %q", name)
+	}
+	for i, item := range items {
+		mapped[i], err = e.filter(name, item, args[1:], kwargs)
+		if _, ok := err.(*SecurityError); ok {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return mapped, nil
+}
+
+// extreme returns the item of v which sorts first, or last if max is true.
+func (e *Environment) extreme(v interface{}, max bool, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "case_sensitive", "attribute")
+	if err != nil {
+		return nil, err
+	}
+	items, err := sequence(v)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	key := e.sortKey(p[1], boolParam(p[0], false))
+	best := items[0]
+	bestKey, err := key(best)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items[1:] {
+		k, err := key(item)
+		if err != nil {
+			return nil, err
+		}
+		c, err := compare(k, bestKey)
+		if err != nil {
+			return nil, err
+		}
+		if (max && c > 0) || (!max && c < 0) {
+			best, bestKey = item, k
+		}
+	}
+	return best, nil
+}
+
+func (e *Environment) filterMax(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	return e.extreme(v, true, args, kwargs)
+}
+
+func (e *Environment) filterMin(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	return e.extreme(v, false, args, kwargs)
+}
+
+// selectItems returns the items of v for which the test named in args
+// returns want.  If no test is named, the truth of each item is tested.  If
+// attr is not empty, the test is applied to that attribute of each item.
+func (e *Environment) selectItems(v interface{}, attr string, want bool, args Args) (interface{}, error) {
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	selected := []interface{}{}
+	for _, item := range items {
+		val := item
+		if attr != "" {
+			var ok bool
+			if val, ok, err = e.attribute(item, attr); err != nil {
+				return nil, err
+			} else if !ok {
+				val = undefined{attr}
+			}
+		}
+		ok := truthy(val)
+		if len(args) > 0 {
+			if ok, err = e.test(asString(args[0]), val, args[1:], nil); err != nil {
+				return nil, err
+			}
+		}
+		if ok == want {
+			selected = append(selected, item)
+		}
+	}
+	return selected, nil
+}
+
+func (e *Environment) filterSelect(v interface{}, args Args) (interface{}, error) {
+	return e.selectItems(v, "", true, args)
+}
+
+func (e *Environment) filterReject(v interface{}, args Args) (interface{}, error) {
+	return e.selectItems(v, "", false, args)
+}
+
+func (e *Environment) filterSelectattr(v interface{}, attr string, args Args) (interface{}, error) {
+	return e.selectItems(v, attr, true, args)
+}
+
+func (e *Environment) filterRejectattr(v interface{}, attr string, args Args) (interface{}, error) {
+	return e.selectItems(v, attr, false, args)
+}
+
+// filterReplace replaces occurrences of old with new.  If count is passed,
+// only the first count occurrences are replaced.
+func filterReplace(v interface{}, old, new string, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "count")
+	if err != nil {
+		return nil, err
+	}
+	count, err := intParam(p[0], -1)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Replace(asString(v), old, new, count), nil
+}
+
+func (e *Environment) filterReverse(v interface{}) (interface{}, error) {
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	if _, ok := v.(string); ok {
+		return e.filterJoin(items, nil, nil)
+	}
+	return items, nil
+}
+
+// filterRound rounds a number to precision decimal places.  The method is
+// "common" to round to the nearest value, with halves rounded to even as in
+// Python, or "ceil" or "floor" to always round up or down.
+func filterRound(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "precision", "method")
+	if err != nil {
+		return nil, err
+	}
+	f, ok := asFloat(v)
+	if !ok {
+		return nil, fmt.Errorf("round of %T", v)
+	}
+	precision, err := intParam(p[0], 0)
+	if err != nil {
+		return nil, err
+	}
+	var round func(float64) float64
+	switch method := stringParam(p[1], "common"); method {
+	case "common":
+		round = math.RoundToEven
+	case "ceil":
+		round = math.Ceil
+	case "floor":
+		round = math.Floor
+	default:
+		return nil, fmt.Errorf("method must be common, ceil or floor")
+	}
+	scale := math.Pow10(precision)
+	return round(f*scale) / scale, nil
+}
+
+// filterSlice slices the items of v into n lists of roughly equal length,
+// filling out the shorter lists with fill_with if it is passed.
+func filterSlice(v interface{}, n int, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "fill_with")
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("number of slices must be positive")
+	}
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	per, extra := len(items)/n, len(items)%n
+	slices := make([]interface{}, n)
+	offset := 0
+	for i := range slices {
+		start := offset + i*per
+		if i < extra {
+			offset++
+		}
+		end := offset + (i+1)*per
+		slice := append([]interface{}{}, items[start:end]...)
+		if p[0] != nil && i >= extra && extra > 0 {
+			slice = append(slice, p[0])
+		}
+		slices[i] = slice
+	}
+	return slices, nil
+}
+
+// filterSort sorts the items of v, or sorts them by attribute.  Strings are
+// compared without regard to case unless case_sensitive is true.
+func (e *Environment) filterSort(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "reverse", "case_sensitive", "attribute")
+	if err != nil {
+		return nil, err
+	}
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	err = sortItems(items, e.sortKey(p[2], boolParam(p[1], false)), boolParam(p[0], false))
+	return items, err
+}
+
+func filterString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return asString(v)
+}
+
+// filterSafe marks v as safe HTML, so that it is not autoescaped.
+func filterSafe(v interface{}) Markup {
+	if v == nil {
+		return ""
+	}
+	return Markup(asString(v))
+}
+
+var tagPattern = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+
+// filterStriptags removes SGML/XML tags from v, unescapes entities and
+// collapses runs of whitespace into single spaces.
+func filterStriptags(v interface{}) string {
+	s := tagPattern.ReplaceAllString(asString(v), "")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+// filterSum adds up the items of v, or their attribute, starting from start.
+// Items are added together as with the + operator.
+func (e *Environment) filterSum(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "attribute", "start")
+	if err != nil {
+		return nil, err
+	}
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	var total interface{} = int64(0)
+	if p[1] != nil {
+		total = p[1]
+	}
+	plus := item{typ: tokenAdd, val: "+"}
+	for _, item := range items {
+		if p[0] != nil {
+			if item, _, err = e.attribute(item, asString(p[0])); err != nil {
+				return nil, err
+			}
+		}
+		if total, err = evalAdd(total, item, plus); err != nil {
+			return nil, err
+		}
+	}
+	return total, nil
+}
+
+// filterTitle capitalizes the first letter of each word and lowercases the
+// rest.
+func filterTitle(v interface{}) interface{} {
+	s := []rune(asString(v))
+	start := true
+	for i, r := range s {
+		if start {
+			s[i] = unicode.ToUpper(r)
+		} else {
+			s[i] = unicode.ToLower(r)
+		}
+		start = unicode.IsSpace(r) || strings.ContainsRune("-([{<", r)
+	}
+	return keepSafe(v, string(s))
+}
+
+// filterTojson serializes v to JSON which is safe to use in HTML, indenting
+// it if indent is passed.
+func (e *Environment) filterTojson(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "indent")
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if p[0] != nil {
+		var indent int
+		if indent, err = intParam(p[0], 0); err != nil {
+			return nil, err
+		}
+		if err = e.checkSize(int64(indent)); err != nil {
+			return nil, err
+		}
+		b, err = json.MarshalIndent(v, "", strings.Repeat(" ", indent))
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// json escapes <, > and & already
+	return Markup(bytes.Replace(b, []byte("'"), []byte(`\u0027`), -1)), nil
+}
+
+// filterTrim strips leading and trailing whitespace, or the given chars.
+func filterTrim(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "chars")
+	if err != nil {
+		return nil, err
+	}
+	if p[0] == nil {
+		return keepSafe(v, strings.TrimSpace(asString(v))), nil
+	}
+	return keepSafe(v, strings.Trim(asString(v), asString(p[0]))), nil
+}
+
+// filterTruncate truncates a string to length characters, ending it with end.
+// Unless killwords is true the last word is discarded rather than cut.
+// Strings which are at most leeway characters too long are not truncated.
+func filterTruncate(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "length", "killwords", "end", "leeway")
+	if err != nil {
+		return nil, err
+	}
+	length, err := intParam(p[0], 255)
+	if err != nil {
+		return nil, err
+	}
+	leeway, err := intParam(p[3], 5)
+	if err != nil {
+		return nil, err
+	}
+	end := stringParam(p[2], "...")
+	s := []rune(asString(v))
+	if len(s) <= length+leeway {
+		return string(s), nil
+	}
+	n := length - utf8.RuneCountInString(end)
+	if n < 0 {
+		n = 0
+	}
+	result := string(s[:n])
+	if !boolParam(p[1], false) {
+		if i := strings.LastIndex(result, " "); i >= 0 {
+			result = result[:i]
+		}
+	}
+	return result + end, nil
+}
+
+// filterUnique returns the unique items of v in the order they first appear.
+func (e *Environment) filterUnique(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "case_sensitive", "attribute")
+	if err != nil {
+		return nil, err
+	}
+	items, err := sequence(v)
+	if err != nil {
+		return nil, err
+	}
+	key := e.sortKey(p[1], boolParam(p[0], false))
+	unique := []interface{}{}
+	var seen []interface{}
+	for _, item := range items {
+		k, err := key(item)
+		if err != nil {
+			return nil, err
+		}
+		if !containsKey(seen, k) {
+			seen = append(seen, k)
+			unique = append(unique, item)
+		}
+	}
+	return unique, nil
+}
+
+// containsKey returns whether keys contains a value equal to k.
+func containsKey(keys []interface{}, k interface{}) bool {
+	for _, key := range keys {
+		if c, err := compare(k, key); err == nil {
+			if c == 0 {
+				return true
+			}
+		} else if reflect.DeepEqual(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterUpper(v interface{}) interface{} {
+	return keepSafe(v, strings.ToUpper(asString(v)))
+}
+
+// urlQuote percent-encodes s, leaving unreserved characters and any of the
+// characters in safe as they are.
+func urlQuote(s, safe string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < utf8.RuneSelf && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || strings.IndexByte("_.-~"+safe, c) >= 0) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// filterUrlencode quotes a string for use in a URL.  Maps and sequences of
+// pairs are encoded as a query string.
+func filterUrlencode(v interface{}) (interface{}, error) {
+	var pairs []interface{}
+	switch rv := reflect.ValueOf(v); {
+	case v == nil:
+		return "", nil
+	case rv.Kind() == reflect.Map:
+		for _, k := range sortedKeys(rv) {
+			pairs = append(pairs, []interface{}{k.Interface(), rv.MapIndex(k).Interface()})
+		}
+	case rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array:
+		pairs, _ = iterate(v)
+	default:
+		return urlQuote(asString(v), "/"), nil
+	}
+	query := make([]string, len(pairs))
+	for i, pair := range pairs {
+		kv, err := unpack(pair, 2)
+		if err != nil {
+			return nil, err
+		}
+		query[i] = urlQuote(asString(kv[0]), "") + "=" + urlQuote(asString(kv[1]), "")
+	}
+	return strings.Join(query, "&"), nil
+}
+
+// filterWordcount counts the words in a string.
+func filterWordcount(v interface{}) int {
+	return len(strings.FieldsFunc(asString(v), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}))
+}
+
+// filterWordwrap wraps a string so no line is longer than width (79)
+// characters, joining lines with wrapstring ("\n").  Words longer than
+// width are broken up unless break_long_words is false.
+func (e *Environment) filterWordwrap(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "width", "break_long_words", "wrapstring")
+	if err != nil {
+		return nil, err
+	}
+	width, err := intParam(p[0], 79)
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 {
+		return nil, fmt.Errorf("width must be positive")
+	}
+	breakLong := boolParam(p[1], true)
+
+	var lines []string
+	for _, para := range strings.Split(asString(v), "\n") {
+		var line []rune
+		for _, word := range strings.Fields(para) {
+			w := []rune(word)
+			if len(line) > 0 && len(line)+1+len(w) > width {
+				lines = append(lines, string(line))
+				line = nil
+			}
+			if len(line) > 0 {
+				line = append(line, ' ')
+			}
+			for breakLong && len(line)+len(w) > width {
+				n := width - len(line)
+				lines = append(lines, string(append(line, w[:n]...)))
+				line, w = nil, w[n:]
+			}
+			line = append(line, w...)
+		}
+		lines = append(lines, string(line))
+	}
+	wrap := stringParam(p[2], "\n")
+	size := int64(len(wrap)) * int64(len(lines))
+	for _, line := range lines {
+		size += int64(len(line))
+	}
+	if err := e.checkSize(size); err != nil {
+		return nil, err
+	}
+	return strings.Join(lines, wrap), nil
+}
+
+// filterXmlattr renders the items of a map as XML/HTML attributes.  Items
+// with nil or undefined values are skipped.  Unless autospace is false, the result starts
+// with a space.
+func filterXmlattr(v interface{}, args Args, kwargs Kwargs) (interface{}, error) {
+	p, err := params(args, kwargs, "autospace")
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return nil, fmt.Errorf("xmlattr of %T", v)
+	}
+	var attrs []string
+	for _, k := range sortedKeys(rv) {
+		val := rv.MapIndex(k).Interface()
+		if val == nil || isUndefined(val) {
+			continue
+		}
+		attrs = append(attrs, fmt.Sprintf(`%s="%s"`, filterEscape(k.Interface()), filterEscape(val)))
+	}
+	s := strings.Join(attrs, " ")
+	if s != "" && boolParam(p[0], true) {
+		s = " " + s
+	}
+	return attributes(s), nil
+}
@@ -0,0 +1,82 @@
+package jigo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBuiltinFilters(t *testing.T) {
+	users := []interface{}{
+		m{"name": "bob", "age": 30, "city": "Paris"},
+		m{"name": "alice", "age": 25, "city": "Berlin"},
+		m{"name": "Carol", "age": 35, "city": "Paris"},
+	}
+	fixtures := []evalFixture{
+		{"abs", `{{ n|abs }} {{ f|abs }}`, m{"n": -3, "f": -1.5}, "3 1.5"},
+		{"capitalize", `{{ "hELLO wORLD"|capitalize }}`, m{}, "Hello world"},
+		{"center", `[{{ "ab"|center(6) }}][{{ "abc"|center(width=6) }}]`, m{}, "[  ab  ][ abc  ]"},
+		{"default", `{{ missing|default("x") }}{{ name|d("x") }}{{ missing|default }}`, m{"name": "y"}, "xy"},
+		{"default boolean", `{{ empty|default("x") }}{{ empty|default("x", true) }}`, m{"empty": ""}, "x"},
+		{"dictsort", `{% for k, v in d|dictsort %}{{ k }}={{ v }} {% endfor %}`, m{"d": m{"b": 1, "A": 2, "c": 0}}, "A=2 b=1 c=0 "},
+		{"dictsort value", `{% for k, v in d|dictsort(by="value", reverse=true) %}{{ k }}{% endfor %}`, m{"d": m{"b": 1, "A": 2, "c": 0}}, "Abc"},
+		{"escape", `{{ s|escape }} {{ s|e }}`, m{"s": `<a href="x">&'`}, "&lt;a href=&#34;x&#34;&gt;&amp;&#39; &lt;a href=&#34;x&#34;&gt;&amp;&#39;"},
+		{"first last", `{{ l|first }}{{ l|last }}{{ "xyz"|first }}{{ empty|first }}`, m{"l": []int{1, 2, 3}, "empty": []int{}}, "13x"},
+		{"float", `{{ "1.5"|float }} {{ 2|float + 0.5 }} {{ "x"|float }} {{ "x"|float(1.5) }}`, m{}, "1.5 2.5 0 1.5"},
+		{"int", `{{ "42"|int }} {{ 3.9|int }} {{ "x"|int }} {{ "x"|int(7) }} {{ "ff"|int(base=16) }} {{ "0x1A"|int(0, 16) }}`, m{}, "42 3 0 7 255 26"},
+		{"format", `{{ "%s has %d %s"|format(name, 3, "cats") }}`, m{"name": "Ann"}, "Ann has 3 cats"},
+		{"groupby", `{% for city, people in users|groupby("city") %}{{ city }}:{{ people|map(attribute="name")|join(",") }};{% endfor %}`, m{"users": users}, "Berlin:alice;Paris:bob,Carol;"},
+		{"groupby attrs", `{% for g in users|groupby("city") %}{{ g.grouper }}{{ g.list|length }}{% endfor %}`, m{"users": users}, "Berlin1Paris2"},
+		{"indent", `{{ s|indent(2) }}|{{ s|indent("> ", first=true) }}`, m{"s": "a\nb\n\nc"}, "a\n  b\n\n  c|> a\n> b\n\n> c"},
+		{"join", `{{ l|join }} {{ l|join(", ") }} {{ users|join("/", attribute="name") }}`, m{"l": []int{1, 2}, "users": users}, "12 1, 2 bob/alice/Carol"},
+		{"length", `{{ l|length }} {{ "日本語"|length }} {{ d|length }} {{ missing|length }}`, m{"l": []int{1, 2}, "d": m{"a": 1}}, "2 3 1 0"},
+		{"list", `{{ "abc"|list|join("-") }}`, m{}, "a-b-c"},
+		{"lower upper", `{{ "AbC"|lower }}{{ "AbC"|upper }}`, m{}, "abcABC"},
+		{"map", `{{ l|map("upper")|join }} {{ l|map("replace", "a", "o")|join(" ") }}`, m{"l": []string{"ab", "ca"}}, "ABCA ob co"},
+		{"map attribute", `{{ users|map(attribute="age")|join(",") }} {{ users|map(attribute="x", default="-")|join }}`, m{"users": users}, "30,25,35 ---"},
+		{"max min", `{{ l|max }} {{ l|min }} {{ s|max }} {{ s|min(case_sensitive=true) }}`, m{"l": []float64{2, 3.5, 1}, "s": []string{"b", "a", "C"}}, "3.5 1 C C"},
+		{"max attribute", `{{ users|max(attribute="age")|dictsort|first|last }}`, m{"users": users}, "35"},
+		{"select reject", `{{ l|select|join }} {{ l|reject|join }}`, m{"l": []interface{}{0, 1, "", "a", nil, 2}}, "1a2 0"},
+		{"selectattr", `{{ l|selectattr("on")|map(attribute="n")|join }}{{ l|rejectattr("on")|map(attribute="n")|join }}`, m{"l": []m{{"n": 1, "on": true}, {"n": 2, "on": false}}}, "12"},
+		{"replace", `{{ "aaa"|replace("a", "b") }} {{ "aaa"|replace("a", "b", 2) }}`, m{}, "bbb bba"},
+		{"reverse", `{{ "abc"|reverse }} {{ l|reverse|join }}`, m{"l": []int{1, 2, 3}}, "cba 321"},
+		{"round", `{{ 2.5|round }} {{ 3.5|round }} {{ 2.567|round(2) }} {{ 2.1|round(method="ceil") }} {{ 2.9|round(0, "floor") }}`, m{}, "2 4 2.57 3 2"},
+		{"slice", `{% for col in l|slice(3) %}[{{ col|join }}]{% endfor %}`, m{"l": []int{1, 2, 3, 4, 5, 6, 7}}, "[123][45][67]"},
+		{"slice fill", `{% for col in l|slice(3, 0) %}[{{ col|join }}]{% endfor %}`, m{"l": []int{1, 2, 3, 4, 5, 6, 7}}, "[123][450][670]"},
+		{"batch", `{% for row in l|batch(3) %}[{{ row|join }}]{% endfor %}{% for row in l|batch(3, "x") %}[{{ row|join }}]{% endfor %}`, m{"l": []int{1, 2, 3, 4}}, "[123][4][123][4xx]"},
+		{"sort", `{{ l|sort|join }} {{ l|sort(true)|join }} {{ s|sort|join }} {{ s|sort(case_sensitive=true)|join }}`, m{"l": []int{3, 1, 2}, "s": []string{"b", "C", "a"}}, "123 321 abC Cab"},
+		{"sort attribute", `{{ users|sort(attribute="age")|map(attribute="name")|join(",") }}`, m{"users": users}, "alice,bob,Carol"},
+		{"string", `{{ 1|string + "2" }}`, m{}, "12"},
+		{"striptags", `{{ s|striptags }}`, m{"s": "<p>Hello  <b>big</b>\n<!-- x -->world &amp; all</p>"}, "Hello big world & all"},
+		{"sum", `{{ l|sum }} {{ f|sum }} {{ l|sum(start=10) }} {{ users|sum(attribute="age") }}`, m{"l": []int{1, 2, 3}, "f": []float64{0.5, 1}, "users": users}, "6 1.5 16 90"},
+		{"title", `{{ "hello wORLD-wide (web)"|title }}`, m{}, "Hello World-Wide (Web)"},
+		{"tojson", `{{ v|tojson }}`, m{"v": m{"a": []interface{}{1, "<b>'"}}}, `{"a":[1,"\u003cb\u003e\u0027"]}`},
+		{"tojson indent", `{{ v|tojson(2) }}`, m{"v": []int{1}}, "[\n  1\n]"},
+		{"trim", `[{{ "  a b  "|trim }}][{{ "xxaxx"|trim("x") }}]`, m{}, "[a b][a]"},
+		{"truncate", `{{ s|truncate(9) }}|{{ s|truncate(9, true) }}|{{ s|truncate(9, end="!", leeway=0) }}|{{ s|truncate(20) }}`, m{"s": "foo bar baz qux"}, "foo...|foo ba...|foo bar!|foo bar baz qux"},
+		{"unique", `{{ l|unique|join }} {{ s|unique|join }} {{ s|unique(true)|join }}`, m{"l": []int{1, 2, 1, 3, 2}, "s": []string{"a", "A", "b"}}, "123 ab aAb"},
+		{"urlencode", `{{ "a b/c&d"|urlencode }} {{ q|urlencode }}`, m{"q": m{"q": "x y", "a": "&"}}, "a%20b/c%26d a=%26&q=x%20y"},
+		{"wordcount", `{{ "Hello, world! It's me."|wordcount }}`, m{}, "5"},
+		{"wordwrap", `{{ s|wordwrap(10) }}|{{ "abcdefghij"|wordwrap(4, wrapstring="-") }}`, m{"s": "the quick brown fox jumps"}, "the quick\nbrown fox\njumps|abcd-efgh-ij"},
+		{"xmlattr", `<a{{ d|xmlattr }}>`, m{"d": m{"href": "/?a=1&b=2", "id": "x", "skip": nil}}, `<a href="/?a=1&amp;b=2" id="x">`},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+}
+
+func TestBuiltinFilterErrors(t *testing.T) {
+	e := NewEnvironment()
+	testRenderErrors(t, e, []string{
+		`{{ "x"|abs }}`,
+		`{{ n|abs }}`,
+		`{{ l|sort }}`,
+		`{{ l|batch(0) }}`,
+		`{{ "x"|center(1, 2) }}`,
+		`{{ "x"|center(size=1) }}`,
+		`{{ l|map }}`,
+		`{{ l|map("nope") }}`,
+		`{{ l|select("nope") }}`,
+		`{{ d|dictsort(by="x") }}`,
+		`{{ 1|round(method="x") }}`,
+		`{{ 1|length }}`,
+		`{{ l|sum }}`,
+	}, m{"l": []interface{}{1, "a"}, "d": m{}, "n": math.MinInt64})
+}
@@ -0,0 +1,208 @@
+package jigo
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Args holds the extra positional arguments passed to a function.  If the
+// final parameter of a function (or the one before a final Kwargs) is of
+// type Args, it accepts any number of extra positional arguments.
+type Args []interface{}
+
+// Kwargs holds the keyword arguments passed to a function.  Only functions
+// whose final parameter is of type Kwargs accept keyword arguments.
+type Kwargs map[string]interface{}
+
+var (
+	argsType   = reflect.TypeOf(Args(nil))
+	kwargsType = reflect.TypeOf(Kwargs(nil))
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// callFunc calls the Go function fn with the given arguments, converting
+// them to the types of fn's parameters.  fn may return a single value, or a
+// value and an error.  Panics in fn are recovered and returned as errors.
+func callFunc(fn interface{}, args []interface{}, kwargs map[string]interface{}) (result interface{}, err error) {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func || f.IsNil() {
+		return nil, fmt.Errorf("%T is not callable", fn)
+	}
+	in, err := bindArgs(f.Type(), args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic in call: %v", e)
+		}
+	}()
+	out := f.Call(in)
+
+	switch len(out) {
+	case 0:
+		return nil, nil
+	case 1:
+		if f.Type().Out(0) == errorType {
+			err, _ := out[0].Interface().(error)
+			return nil, err
+		}
+		return out[0].Interface(), nil
+	default:
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		return out[0].Interface(), nil
+	}
+}
+
+// bindArgs converts positional and keyword arguments into a list of values
+// suitable for calling a function of type ft.
+func bindArgs(ft reflect.Type, args []interface{}, kwargs map[string]interface{}) ([]reflect.Value, error) {
+	nin := ft.NumIn()
+	if ft.NumOut() > 2 || (ft.NumOut() == 2 && ft.Out(1) != errorType) {
+		return nil, fmt.Errorf("function must return one value, or a value and an error")
+	}
+
+	hasKwargs := nin > 0 && ft.In(nin-1) == kwargsType
+	if hasKwargs {
+		nin--
+	}
+	hasArgs := nin > 0 && ft.In(nin-1) == argsType
+	variadic := ft.IsVariadic()
+	fixed := nin
+	if hasArgs || variadic {
+		fixed--
+	}
+
+	if len(args) < fixed {
+		return nil, fmt.Errorf("not enough arguments: want %d, got %d", fixed, len(args))
+	}
+	if len(args) > fixed && !hasArgs && !variadic {
+		return nil, fmt.Errorf("too many arguments: want %d, got %d", fixed, len(args))
+	}
+	if len(kwargs) > 0 && !hasKwargs {
+		return nil, fmt.Errorf("function does not accept keyword arguments")
+	}
+
+	in := make([]reflect.Value, 0, ft.NumIn())
+	for i := 0; i < fixed; i++ {
+		v, err := convertArg(args[i], ft.In(i))
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %s", i+1, err)
+		}
+		in = append(in, v)
+	}
+	switch {
+	case hasArgs:
+		in = append(in, reflect.ValueOf(Args(args[fixed:])))
+	case variadic:
+		elem := ft.In(fixed).Elem()
+		for i := fixed; i < len(args); i++ {
+			v, err := convertArg(args[i], elem)
+			if err != nil {
+				return nil, fmt.Errorf("argument %d: %s", i+1, err)
+			}
+			in = append(in, v)
+		}
+	}
+	if hasKwargs {
+		kw := make(Kwargs, len(kwargs))
+		for k, v := range kwargs {
+			kw[k] = v
+		}
+		in = append(in, reflect.ValueOf(kw))
+	}
+	return in, nil
+}
+
+// convertArg converts the template value v into a value of type t.  Numeric
+// values are converted between numeric types if it can be done without loss,
+// and values are converted between named types of the same kind.  Slices and
+// maps are converted item by item, so that a list literal may be passed as a
+// []string.
+func convertArg(v interface{}, t reflect.Type) (reflect.Value, error) {
+	if v == nil {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return reflect.Zero(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use nil as %s", t)
+	}
+	if u, ok := v.(undefined); ok && t.Kind() != reflect.Interface {
+		return reflect.Value{}, fmt.Errorf("%s is undefined", u.name)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Type().AssignableTo(t) {
+		return rv, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if typeOf(v) == intType {
+			i, _ := asInteger(v)
+			out := reflect.New(t).Elem()
+			if !out.OverflowInt(i) && (rv.Kind() != reflect.Uint64 || i >= 0) {
+				out.SetInt(i)
+				return out, nil
+			}
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", v, t)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if typeOf(v) == intType {
+			i, _ := asInteger(v)
+			u := uint64(i)
+			switch rv.Kind() {
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				u, i = rv.Uint(), 0
+			}
+			out := reflect.New(t).Elem()
+			if i >= 0 && !out.OverflowUint(u) {
+				out.SetUint(u)
+				return out, nil
+			}
+			return reflect.Value{}, fmt.Errorf("%v overflows %s", v, t)
+		}
+	case reflect.Float32, reflect.Float64:
+		if isNumericVar(typeOf(v)) {
+			f, _ := asFloat(v)
+			out := reflect.New(t).Elem()
+			out.SetFloat(f)
+			return out, nil
+		}
+	case reflect.Slice:
+		// list literals are []interface{}, and are converted element-wise
+		if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			out := reflect.MakeSlice(t, rv.Len(), rv.Len())
+			for i := 0; i < rv.Len(); i++ {
+				elem, err := convertArg(rv.Index(i).Interface(), t.Elem())
+				if err != nil {
+					return reflect.Value{}, fmt.Errorf("item %d: %s", i, err)
+				}
+				out.Index(i).Set(elem)
+			}
+			return out, nil
+		}
+	case reflect.Map:
+		if rv.Kind() == reflect.Map {
+			out := reflect.MakeMapWithSize(t, rv.Len())
+			for _, k := range rv.MapKeys() {
+				key, err := convertArg(k.Interface(), t.Key())
+				if err != nil {
+					return reflect.Value{}, fmt.Errorf("key %v: %s", k, err)
+				}
+				elem, err := convertArg(rv.MapIndex(k).Interface(), t.Elem())
+				if err != nil {
+					return reflect.Value{}, fmt.Errorf("item %v: %s", k, err)
+				}
+				out.SetMapIndex(key, elem)
+			}
+			return out, nil
+		}
+	}
+	if rv.Kind() == t.Kind() && rv.Type().ConvertibleTo(t) {
+		return rv.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %T as %s", v, t)
+}
@@ -0,0 +1,58 @@
+package jigo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCallFunc(t *testing.T) {
+	type name string
+	tests := []struct {
+		fn     interface{}
+		args   []interface{}
+		kwargs map[string]interface{}
+		result interface{}
+		isErr  bool
+	}{
+		{func() int { return 1 }, nil, nil, 1, false},
+		{func(a, b int) int { return a + b }, []interface{}{int64(1), int64(2)}, nil, 3, false},
+		{func(a int8) int8 { return a }, []interface{}{int64(300)}, nil, nil, true},
+		{func(a uint) uint { return a }, []interface{}{int64(-1)}, nil, nil, true},
+		{func(a float64) float64 { return a }, []interface{}{int64(2)}, nil, 2.0, false},
+		{func(n name) string { return string(n) }, []interface{}{"x"}, nil, "x", false},
+		{func(a int) int { return a }, []interface{}{"x"}, nil, nil, true},
+		{func(a int) int { return a }, nil, nil, nil, true},
+		{func(a int) int { return a }, []interface{}{1, 2}, nil, nil, true},
+		{func(a int) int { return a }, []interface{}{1}, map[string]interface{}{"b": 1}, nil, true},
+		{func(a ...int) int { return len(a) }, []interface{}{1, 2, 3}, nil, 3, false},
+		{func(a int, args Args) int { return a + len(args) }, []interface{}{1, "x", "y"}, nil, 3, false},
+		{func(kw Kwargs) interface{} { return kw["b"] }, nil, map[string]interface{}{"b": 2}, 2, false},
+		{func(v interface{}) interface{} { return v }, []interface{}{nil}, nil, nil, false},
+		{func(s []string) int { return len(s) }, []interface{}{[]interface{}{"a", "b"}}, nil, 2, false},
+		{func(s []int8) int { return len(s) }, []interface{}{[]interface{}{int64(1), "b"}}, nil, nil, true},
+		{func(m map[string]int) int { return m["a"] }, []interface{}{map[string]interface{}{"a": int64(1)}}, nil, 1, false},
+		{func() (int, error) { return 0, errors.New("fail") }, nil, nil, nil, true},
+		{func() error { return nil }, nil, nil, nil, false},
+		{func() int { panic("boom") }, nil, nil, nil, true},
+		{func() (int, int) { return 1, 2 }, nil, nil, nil, true},
+		{"not a func", nil, nil, nil, true},
+	}
+
+	for i, test := range tests {
+		result, err := callFunc(test.fn, test.args, test.kwargs)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%d: expected %#v, got %#v", i, test.result, result)
+		}
+	}
+}
@@ -43,28 +43,52 @@ func (i item) String() string {
 
 // Return operator precedence.  If it is not an operator, returns 0
 // The index operator is special cased to have the highest priorty by the
-// parser's maybeIndexExpr function.
-// Precedence    Operator
-//    5             *  /  //  %
-//    4             +  -
-//    3             ==  !=  <  <=  >  >=
-//    2             &&
-//    1             ||
+// parser's maybeIndexExpr function.  Unary `not` binds less tightly than
+// comparisons, but more tightly than `and`.  `**` is right associative.
+//
+//	Precedence    Operator
+//	   7             **
+//	   6             *  /  //  %
+//	   5             +  -
+//	   4             ~
+//	   3             ==  !=  <  <=  >  >=  in  not in
+//	   2             &&  and
+//	   1             ||  or
 func (i item) precedence() int {
 	switch i.typ {
+	case tokenPow:
+		return 7
 	case tokenMul, tokenDiv, tokenFloordiv, tokenMod:
-		return 5
+		return 6
 	case tokenAdd, tokenSub:
+		return 5
+	case tokenTilde:
 		return 4
 	case tokenEqEq, tokenNeq, tokenLt, tokenLteq, tokenGt, tokenGteq:
-		return 3
+		return precedenceCompare
 	case tokenAnd:
 		return 2
 	case tokenOr:
 		return 1
-	default:
-		return 0
+	case tokenName:
+		switch i.val {
+		case "in", "not in":
+			return precedenceCompare
+		case "and":
+			return 2
+		case "or":
+			return 1
+		}
 	}
+	return 0
+}
+
+// precedenceCompare is the precedence of the comparison operators.
+const precedenceCompare = 3
+
+// isComparison returns whether the item is a comparison operator.
+func (i item) isComparison() bool {
+	return i.precedence() == precedenceCompare
 }
 
 // Token definitions from jinja/lexer.py
@@ -126,6 +150,7 @@ const (
 	tokenError
 	// add a distinct token for bool constants
 	tokenBool
+	tokenNone
 )
 
 // stateFn represents the state of the scanner as a function that returns the next state.
@@ -138,6 +163,8 @@ type lexerCfg struct {
 	VariableEndString   string
 	CommentStartString  string
 	CommentEndString    string
+	TrimBlocks          bool
+	LstripBlocks        bool
 }
 
 // lexer holds the state of the scanner.
@@ -309,7 +336,7 @@ func (l *lexer) atTerminator() bool {
 	}
 	// if r is an operator...
 	switch r {
-	case eof, '.', ',', '|', ':', ')', '(', '+', '/', '~', '{', '}', '-', '%', '*', '=', '!', '&':
+	case eof, '.', ',', '|', ':', ')', '(', '+', '/', '~', '{', '}', '[', ']', '-', '%', '*', '=', '!', '&':
 		return true
 	}
 
@@ -329,8 +356,12 @@ func lexText(l *lexer) stateFn {
 		}
 		switch l.input[l.pos] {
 		case l.BlockStartString[0]:
+			if end, modifier, ok := l.blockTag(l.pos, "raw"); ok {
+				l.emitTextBefore(l.BlockStartString, true)
+				return l.lexRaw(end, modifier)
+			}
 			if strings.HasPrefix(l.input[l.pos:], l.BlockStartString) {
-				l.emitText()
+				l.emitTextBefore(l.BlockStartString, true)
 				l.leftDelim = l.BlockStartString
 				l.rightDelim = l.BlockEndString
 				return lexBlock
@@ -338,7 +369,7 @@ func lexText(l *lexer) stateFn {
 			fallthrough
 		case l.VariableStartString[0]:
 			if strings.HasPrefix(l.input[l.pos:], l.VariableStartString) {
-				l.emitText()
+				l.emitTextBefore(l.VariableStartString, false)
 				l.leftDelim = l.VariableStartString
 				l.rightDelim = l.VariableEndString
 				return lexBlock
@@ -346,7 +377,7 @@ func lexText(l *lexer) stateFn {
 			fallthrough
 		case l.CommentStartString[0]:
 			if strings.HasPrefix(l.input[l.pos:], l.CommentStartString) {
-				l.emitText()
+				l.emitTextBefore(l.CommentStartString, true)
 				return lexComment
 			}
 			fallthrough
@@ -362,12 +393,123 @@ func lexText(l *lexer) stateFn {
 	return nil
 }
 
+// modifierAt returns the whitespace control modifier at pos, which is `-` to
+// strip all whitespace on that side of a tag, or `+` to disable TrimBlocks
+// and LstripBlocks for that side of a block or comment tag.  If there is no
+// modifier, it returns 0.
+func (l *lexer) modifierAt(pos Pos, plus bool) byte {
+	if int(pos) < len(l.input) {
+		if c := l.input[pos]; c == '-' || (c == '+' && plus) {
+			return c
+		}
+	}
+	return 0
+}
+
+// emitTextBefore emits the pending text before the tag starting with delim at
+// l.pos.  If the tag starts with a `-` modifier, trailing whitespace is
+// stripped from the text.  Otherwise if lstrip is set, which it is for block
+// and comment tags, LstripBlocks is on, the tag does not start with `+`, and
+// the tag is the first thing on its line, the whitespace before the tag on
+// that line is stripped.
+func (l *lexer) emitTextBefore(delim string, lstrip bool) {
+	text := l.input[l.start:l.pos]
+	switch l.modifierAt(l.pos+Pos(len(delim)), lstrip) {
+	case '-':
+		text = strings.TrimRightFunc(text, unicode.IsSpace)
+	case '+':
+	default:
+		if !lstrip || !l.LstripBlocks {
+			break
+		}
+		nl := strings.LastIndex(text, "\n")
+		line := text[nl+1:]
+		atLineStart := nl >= 0 || l.start == 0 || l.input[l.start-1] == '\n'
+		if atLineStart && strings.Trim(line, " \t") == "" {
+			text = text[:nl+1]
+		}
+	}
+	if len(text) > 0 {
+		l.items <- item{tokenText, l.start, text}
+	}
+	l.start = l.pos
+}
+
+// trimAfter skips whitespace after a tag which ended with modifier.  After
+// a `-`, all whitespace is skipped, and otherwise if trim is set and the
+// modifier is not `+`, a single newline is skipped.
+func (l *lexer) trimAfter(modifier byte, trim bool) {
+	rest := l.input[l.pos:]
+	switch {
+	case modifier == '-':
+		l.pos += Pos(len(rest) - len(strings.TrimLeftFunc(rest, unicode.IsSpace)))
+	case modifier != '+' && trim:
+		if strings.HasPrefix(rest, "\r\n") {
+			l.pos += 2
+		} else if strings.HasPrefix(rest, "\n") {
+			l.pos++
+		}
+	}
+	l.ignore()
+}
+
+// blockTag reports whether there is a `{% name %}` block tag at pos, which
+// may have whitespace control modifiers.  If there is, it returns the end
+// position of the tag and its right modifier.
+func (l *lexer) blockTag(pos Pos, name string) (end Pos, modifier byte, ok bool) {
+	s := l.input[pos:]
+	if !strings.HasPrefix(s, l.BlockStartString) {
+		return 0, 0, false
+	}
+	s = s[len(l.BlockStartString):]
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	s = strings.TrimLeft(s, " \t")
+	if !strings.HasPrefix(s, name) {
+		return 0, 0, false
+	}
+	s = strings.TrimLeft(s[len(name):], " \t")
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		modifier, s = s[0], s[1:]
+	}
+	if !strings.HasPrefix(s, l.BlockEndString) {
+		return 0, 0, false
+	}
+	return Pos(len(l.input) - len(s) + len(l.BlockEndString)), modifier, true
+}
+
+// lexRaw lexes a {% raw %}...{% endraw %} block whose begin tag ends at end
+// with the right modifier.  The content of the block is emitted as text
+// without being lexed.
+func (l *lexer) lexRaw(end Pos, modifier byte) stateFn {
+	l.pos = end
+	l.emit(tokenRawBegin)
+	l.trimAfter(modifier, l.TrimBlocks)
+	for i := l.pos; ; i++ {
+		j := strings.Index(l.input[i:], l.BlockStartString)
+		if j < 0 {
+			return l.errorf("unclosed raw block")
+		}
+		i += Pos(j)
+		if end, modifier, ok := l.blockTag(i, "endraw"); ok {
+			l.pos = i
+			l.emitTextBefore(l.BlockStartString, true)
+			l.pos = end
+			l.emit(tokenRawEnd)
+			l.trimAfter(modifier, l.TrimBlocks)
+			return lexText
+		}
+	}
+}
+
 func lexBlock(l *lexer) stateFn {
 	l.pos += Pos(len(l.leftDelim))
+	if l.modifierAt(l.pos, l.leftDelim == l.BlockStartString) != 0 {
+		l.pos++
+	}
 	l.emitLeft()
 	return lexInsideBlock
-
-	return lexText
 }
 
 func lexInsideBlock(l *lexer) stateFn {
@@ -381,6 +523,16 @@ func lexInsideBlock(l *lexer) stateFn {
 		if strings.HasPrefix(l.input[l.pos:], l.rightDelim) && !l.shouldExpectDelim(l.peek()) {
 			l.pos += Pos(len(l.rightDelim))
 			l.emitRight()
+			l.trimAfter(0, l.TrimBlocks && l.rightDelim == l.BlockEndString)
+			return lexText
+		}
+		// the right delimiter may be preceded by a whitespace control modifier
+		block := l.rightDelim == l.BlockEndString
+		if m := l.modifierAt(l.pos, block); m != 0 && strings.HasPrefix(l.input[l.pos+1:], l.rightDelim) &&
+			!l.shouldExpectDelim(rune(l.rightDelim[0])) {
+			l.pos += 1 + Pos(len(l.rightDelim))
+			l.emitRight()
+			l.trimAfter(m, l.TrimBlocks && block)
 			return lexText
 		}
 		// take the next rune and see what it is
@@ -404,6 +556,8 @@ func lexInsideBlock(l *lexer) stateFn {
 		switch r {
 		case ',':
 			l.emit(tokenComma)
+		case '.':
+			l.emit(tokenDot)
 		case '|':
 			if l.accept("|") {
 				l.emit(tokenOr)
@@ -416,6 +570,8 @@ func lexInsideBlock(l *lexer) stateFn {
 			l.emit(tokenSub)
 		case '~':
 			l.emit(tokenTilde)
+		case '%':
+			l.emit(tokenMod)
 		case ':':
 			l.emit(tokenColon)
 		case '/':
@@ -508,8 +664,10 @@ func lexIdentifier(l *lexer) stateFn {
 				return l.errorf("bad character %#U", r)
 			}
 			switch word {
-			case "true", "false":
+			case "true", "false", "True", "False":
 				l.emit(tokenBool)
+			case "none", "None":
+				l.emit(tokenNone)
 			default:
 				l.emit(tokenName)
 			}
@@ -563,15 +721,29 @@ func lexRawString(l *lexer) stateFn {
 
 func lexComment(l *lexer) stateFn {
 	l.pos += Pos(len(l.CommentStartString))
+	if l.modifierAt(l.pos, true) != 0 {
+		l.pos++
+	}
 	l.emit(tokenCommentBegin)
 	i := strings.Index(l.input[l.pos:], l.CommentEndString)
 	if i < 0 {
 		return l.errorf("unclosed comment")
 	}
 	l.pos += Pos(i)
+	var modifier byte
+	if i > 0 {
+		modifier = l.modifierAt(l.pos-1, true)
+	}
+	if modifier != 0 {
+		l.pos--
+	}
 	l.emitText()
 	l.pos += Pos(len(l.CommentEndString))
+	if modifier != 0 {
+		l.pos++
+	}
 	l.emit(tokenCommentEnd)
+	l.trimAfter(modifier, l.TrimBlocks)
 	return lexText
 }
 
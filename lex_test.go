@@ -147,12 +147,30 @@ func TestLexer(t *testing.T) {
 		`{# comment #}{% if foo -%} bar {%- elif baz %} bing{%endif    %}`,
 		[]tokenTest{
 			ttCommentBegin, tt(" comment "), ttCommentEnd, ttBlockBegin, sp, tn("if"), sp,
-			tn("foo"), sp, ttSub, ttBlockEnd, tt(" bar "), ttBlockBegin, ttSub, sp, tn("elif"),
+			tn("foo"), sp, {tokenBlockEnd, "-%}"}, tt("bar"), {tokenBlockBegin, "{%-"}, sp, tn("elif"),
 			sp, tn("baz"), sp, ttBlockEnd, tt(" bing"), ttBlockBegin, tn("endif"), sp,
 			ttBlockEnd, ttEOF,
 		},
 	)
 
+	tester.Test(
+		`a{% raw %}{{ x }}{% endraw -%} b`,
+		[]tokenTest{
+			tt("a"), {tokenRawBegin, "{% raw %}"}, tt("{{ x }}"), {tokenRawEnd, "{% endraw -%}"}, tt("b"), ttEOF,
+		},
+	)
+
+	// whitespace control modifiers strip whitespace, including newlines
+	tester.Test(
+		"a \n {{- x -}} \n b {#- c -#}\n\tc {%+ if x +%} {{ 1 - 2 }}",
+		[]tokenTest{
+			tt("a"), {tokenVariableBegin, "{{-"}, sp, tn("x"), sp, {tokenVariableEnd, "-}}"}, tt("b"),
+			{tokenCommentBegin, "{#-"}, tt(" c "), {tokenCommentEnd, "-#}"}, tt("c "), {tokenBlockBegin, "{%+"},
+			sp, tn("if"), sp, tn("x"), sp, {tokenBlockEnd, "+%}"}, tt(" "), ttVariableBegin, sp,
+			{tokenInteger, "1"}, sp, ttSub, sp, {tokenInteger, "2"}, sp, ttVariableEnd, ttEOF,
+		},
+	)
+
 	// test a big mess of tokens including single and double character tokens
 	tester.Test(
 		`{{ +--+ /+//,|*/**=>>=<=< == }}`,
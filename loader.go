@@ -0,0 +1,219 @@
+package jigo
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Source is the source of a template, as returned by a Loader.
+type Source struct {
+	Name     string    // The name the template was loaded by.
+	Filename string    // The filename of the template, used for error messages.
+	Text     string    // The template source.
+	Modified time.Time // The last modification time of the template, if known.
+	// UpToDate reports whether the template is unchanged since it was
+	// loaded.  If it is nil, the template is always considered up to date.
+	UpToDate func() bool
+}
+
+// A Loader loads template sources by name.  Template names are always
+// slash separated, regardless of the platform or the underlying storage.
+type Loader interface {
+	// Source returns the source of the named template.  If the template
+	// does not exist, the error is a *NotFoundError.
+	Source(name string) (*Source, error)
+}
+
+// NotFoundError is returned when a template cannot be found.
+type NotFoundError struct {
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("template %q not found", e.Name)
+}
+
+// IsNotFound reports whether err is the result of a template not being found.
+func IsNotFound(err error) bool {
+	var nf *NotFoundError
+	return errors.As(err, &nf)
+}
+
+// splitTemplatePath splits a template name into its path segments.  Names
+// which would escape the root of a loader are rejected.
+func splitTemplatePath(name string) ([]string, error) {
+	var pieces []string
+	for _, piece := range strings.Split(name, "/") {
+		if piece == ".." || strings.ContainsRune(piece, filepath.Separator) {
+			return nil, &NotFoundError{name}
+		}
+		if piece != "" && piece != "." {
+			pieces = append(pieces, piece)
+		}
+	}
+	if len(pieces) == 0 {
+		return nil, &NotFoundError{name}
+	}
+	return pieces, nil
+}
+
+// FileSystemLoader loads templates from a list of directories, which are
+// searched in order.
+type FileSystemLoader struct {
+	Paths []string
+}
+
+// NewFileSystemLoader returns a loader which loads templates from paths.
+func NewFileSystemLoader(paths ...string) *FileSystemLoader {
+	return &FileSystemLoader{Paths: paths}
+}
+
+func (l *FileSystemLoader) Source(name string) (*Source, error) {
+	pieces, err := splitTemplatePath(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range l.Paths {
+		filename := filepath.Join(append([]string{root}, pieces...)...)
+		info, err := os.Stat(filename)
+		if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		text, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		modified := info.ModTime()
+		return &Source{
+			Name:     name,
+			Filename: filename,
+			Text:     string(text),
+			Modified: modified,
+			UpToDate: func() bool {
+				info, err := os.Stat(filename)
+				return err == nil && info.ModTime().Equal(modified)
+			},
+		}, nil
+	}
+	return nil, &NotFoundError{name}
+}
+
+// FSLoader loads templates from an fs.FS, such as an embed.FS.
+type FSLoader struct {
+	FS fs.FS
+}
+
+// NewFSLoader returns a loader which loads templates from fsys.
+func NewFSLoader(fsys fs.FS) *FSLoader {
+	return &FSLoader{FS: fsys}
+}
+
+func (l *FSLoader) Source(name string) (*Source, error) {
+	pieces, err := splitTemplatePath(name)
+	if err != nil {
+		return nil, err
+	}
+	filename := path.Join(pieces...)
+	info, err := fs.Stat(l.FS, filename)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+		return nil, &NotFoundError{name}
+	} else if err != nil {
+		return nil, err
+	}
+	text, err := fs.ReadFile(l.FS, filename)
+	if err != nil {
+		return nil, err
+	}
+	modified := info.ModTime()
+	return &Source{
+		Name:     name,
+		Filename: filename,
+		Text:     string(text),
+		Modified: modified,
+		UpToDate: func() bool {
+			info, err := fs.Stat(l.FS, filename)
+			return err == nil && info.ModTime().Equal(modified)
+		},
+	}, nil
+}
+
+// MapLoader loads templates from a map of names to template sources.
+type MapLoader map[string]string
+
+func (l MapLoader) Source(name string) (*Source, error) {
+	text, ok := l[name]
+	if !ok {
+		return nil, &NotFoundError{name}
+	}
+	return &Source{
+		Name:     name,
+		Filename: name,
+		Text:     text,
+		UpToDate: func() bool {
+			current, ok := l[name]
+			return ok && current == text
+		},
+	}, nil
+}
+
+// PrefixLoader dispatches to one of several loaders based on the prefix of
+// a template name, so that "admin/index.html" loads "index.html" from the
+// loader with the prefix "admin".
+type PrefixLoader struct {
+	Loaders map[string]Loader
+	// The delimiter between the prefix and the name.  Defaults to "/".
+	Delimiter string
+}
+
+// NewPrefixLoader returns a PrefixLoader which dispatches to loaders.
+func NewPrefixLoader(loaders map[string]Loader) *PrefixLoader {
+	return &PrefixLoader{Loaders: loaders, Delimiter: "/"}
+}
+
+func (l *PrefixLoader) Source(name string) (*Source, error) {
+	delim := l.Delimiter
+	if delim == "" {
+		delim = "/"
+	}
+	i := strings.Index(name, delim)
+	if i < 0 {
+		return nil, &NotFoundError{name}
+	}
+	loader, ok := l.Loaders[name[:i]]
+	if !ok {
+		return nil, &NotFoundError{name}
+	}
+	src, err := loader.Source(name[i+len(delim):])
+	if IsNotFound(err) {
+		return nil, &NotFoundError{name}
+	} else if err != nil {
+		return nil, err
+	}
+	src.Name = name
+	return src, nil
+}
+
+// ChoiceLoader tries each of its loaders in order, returning the first
+// template that is found.
+type ChoiceLoader []Loader
+
+func (l ChoiceLoader) Source(name string) (*Source, error) {
+	for _, loader := range l {
+		src, err := loader.Source(name)
+		if err == nil {
+			return src, nil
+		}
+		if !IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, &NotFoundError{name}
+}
@@ -0,0 +1,154 @@
+package jigo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func checkSource(t *testing.T, l Loader, name, text string) {
+	src, err := l.Source(name)
+	if err != nil {
+		t.Errorf("%s: unexpected error %s", name, err)
+		return
+	}
+	if src.Text != text {
+		t.Errorf("%s: expected source `%s`, got `%s`", name, text, src.Text)
+	}
+	if src.Name != name {
+		t.Errorf("%s: expected source name %s, got %s", name, name, src.Name)
+	}
+}
+
+func checkNotFound(t *testing.T, l Loader, name string) {
+	_, err := l.Source(name)
+	if !IsNotFound(err) {
+		t.Errorf("%s: expected not found error, got %v", name, err)
+	}
+}
+
+func TestFileSystemLoader(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "templates")
+	if err := os.MkdirAll(filepath.Join(root, "partials"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(root, "index.html"):           "index",
+		filepath.Join(root, "partials", "nav.html"): "nav",
+		filepath.Join(dir, "secret.txt"):            "secret",
+		filepath.Join(dir, "templates-other.html"):  "other",
+	}
+	for filename, text := range files {
+		if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := NewFileSystemLoader(root)
+	checkSource(t, l, "index.html", "index")
+	checkSource(t, l, "partials/nav.html", "nav")
+	checkSource(t, l, "/partials/./nav.html", "nav")
+	checkNotFound(t, l, "missing.html")
+	checkNotFound(t, l, "partials")
+	checkNotFound(t, l, "../secret.txt")
+	checkNotFound(t, l, "partials/../../secret.txt")
+	checkNotFound(t, l, "")
+
+	src, err := l.Source("index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !src.UpToDate() {
+		t.Error("expected unmodified template to be up to date")
+	}
+	later := src.Modified.Add(time.Second)
+	if err := os.Chtimes(filepath.Join(root, "index.html"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if src.UpToDate() {
+		t.Error("expected modified template to be out of date")
+	}
+}
+
+func TestFSLoader(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":        {Data: []byte("index")},
+		"partials/nav.html": {Data: []byte("nav")},
+	}
+	l := NewFSLoader(fsys)
+	checkSource(t, l, "index.html", "index")
+	checkSource(t, l, "partials/nav.html", "nav")
+	checkNotFound(t, l, "missing.html")
+	checkNotFound(t, l, "partials")
+	checkNotFound(t, l, "../index.html")
+}
+
+func TestMapLoader(t *testing.T) {
+	l := MapLoader{"index.html": "index"}
+	checkSource(t, l, "index.html", "index")
+	checkNotFound(t, l, "missing.html")
+
+	src, _ := l.Source("index.html")
+	if !src.UpToDate() {
+		t.Error("expected unmodified template to be up to date")
+	}
+	l["index.html"] = "changed"
+	if src.UpToDate() {
+		t.Error("expected modified template to be out of date")
+	}
+}
+
+func TestPrefixLoader(t *testing.T) {
+	l := NewPrefixLoader(map[string]Loader{
+		"site":  MapLoader{"index.html": "site index"},
+		"admin": MapLoader{"index.html": "admin index"},
+	})
+	checkSource(t, l, "site/index.html", "site index")
+	checkSource(t, l, "admin/index.html", "admin index")
+	checkNotFound(t, l, "index.html")
+	checkNotFound(t, l, "other/index.html")
+	checkNotFound(t, l, "site/missing.html")
+}
+
+func TestChoiceLoader(t *testing.T) {
+	l := ChoiceLoader{
+		MapLoader{"index.html": "first"},
+		MapLoader{"index.html": "second", "about.html": "about"},
+	}
+	checkSource(t, l, "index.html", "first")
+	checkSource(t, l, "about.html", "about")
+	checkNotFound(t, l, "missing.html")
+}
+
+func TestEnvironmentLoad(t *testing.T) {
+	e := NewEnvironment()
+	if _, err := e.Load("index.html"); !IsNotFound(err) {
+		t.Errorf("expected not found error without a loader, got %v", err)
+	}
+
+	e.Loader = MapLoader{"index.html": "Hello {{ name }}", "bad.html": "{% if %}"}
+	tpl, err := e.Load("index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tpl.Render(m{"name": "World"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Hello World" {
+		t.Errorf("expected `Hello World`, got `%s`", out)
+	}
+	again, err := e.Load("index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != tpl {
+		t.Error("expected the second load to return the cached template")
+	}
+	if _, err := e.Load("bad.html"); err == nil {
+		t.Error("expected a parse error loading bad.html")
+	}
+}
@@ -1,7 +1,10 @@
 package jigo
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"runtime"
 	"strings"
 )
@@ -70,25 +73,31 @@ ExpressionList = Expression { "," Expression }
 Expression = UnaryExpr | Expression binary_op UnaryExpr .
 UnaryExpr  = PrimaryExpr | unary_op UnaryExpr .
 
-binary_op  = "||" | "&&" | rel_op | add_op | mul_op .
-rel_op     = "==" | "!=" | "<" | "<=" | ">" | ">=" .
-add_op     = "+" | "-" | "^" .
+binary_op  = "||" | "or" | "&&" | "and" | rel_op | "~" | add_op | mul_op | "**" .
+rel_op     = "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" | "not in" .
+add_op     = "+" | "-" .
 mul_op     = "*" | "/" | "%" | "//" .
-unary_op   = "+" | "-" | "!" | "*" .
+unary_op   = "+" | "-" | "!" | "not" .
 
 NOTE: Because bitwise or operator | is required as the filter operator,
 the other bitwise &, &^, ^, << and >> and unary ^ operators have been
 removed as their usefulness in templates seems dubious.
 
-In addition, divmod/floordiv (//) has been added, and the channel op `<-`
-has been removed.
+In addition, divmod/floordiv (//), power (**) and string concatenation (~)
+have been added, and the channel op `<-` has been removed.
+
+Filters (`|`) and tests (`is`) apply to a single operand, and bind more
+tightly than any binary operator.  `not` binds less tightly than comparisons,
+and `**` is right associative.
 
 Precedence    Operator
-    5             *  /  //  %
-    4             +  -
-    3             ==  !=  <  <=  >  >=
-    2             &&
-    1             ||
+    7             **
+    6             *  /  //  %
+    5             +  -
+    4             ~
+    3             ==  !=  <  <=  >  >=  in  not in
+    2             &&  and
+    1             ||  or
 
 +    sum                    integers, floats, strings
 -    difference             integers, floats
@@ -96,6 +105,8 @@ Precedence    Operator
 /    quotient               integers, floats
 //   divmod                 integers, floats
 %    remainder              integers
+**   power                  integers, floats
+~    concatenation          any values, as strings
 
 */
 
@@ -103,30 +114,72 @@ type Template struct {
 	Name string
 	base *Tree
 	env  *Environment
+	// uptodate reports whether the template's source is unchanged since it
+	// was loaded; it is nil for templates which were not loaded by name.
+	uptodate func() bool
+}
+
+// Render this template with the given context.  Names which are not in the
+// context are looked up in the environment's Globals.
+func (t *Template) Render(data interface{}) (string, error) {
+	return t.RenderContext(context.Background(), data)
+}
+
+// RenderContext renders this template like Render, but stops with ctx's error
+// if ctx is cancelled or its deadline passes.
+func (t *Template) RenderContext(ctx context.Context, data interface{}) (string, error) {
+	b := new(bytes.Buffer)
+	err := t.ExecuteContext(ctx, b, data)
+	return b.String(), err
 }
 
-// Render this template with the given context.
-func (t *Template) Render(context interface{}) (string, error) {
-	c := NewContextStack(context)
-	r := newRenderer(t)
+// Execute renders this template with the given context like Render, but
+// writes the output to w as it is rendered rather than returning it, so
+// large outputs need not be held in memory.  Writes are not buffered, so w
+// should be buffered if small writes to it are expensive.  An error writing
+// to w stops rendering and is returned as is.
+func (t *Template) Execute(w io.Writer, data interface{}) error {
+	return t.ExecuteContext(context.Background(), w, data)
+}
+
+// ExecuteContext renders this template to w like Execute, but stops with
+// ctx's error if ctx is cancelled or its deadline passes.  Cancellation is
+// checked on each loop iteration, macro call and include.
+func (t *Template) ExecuteContext(ctx context.Context, w io.Writer, data interface{}) error {
+	c := NewContextStack(t.env.Globals)
+	vars, err := NewContext(data)
+	if err != nil {
+		return err
+	}
+	vars.policy = t.env.Sandbox
+	c.push(vars)
+	if t.env.MaxOutput > 0 {
+		w = &limitWriter{w: w, max: t.env.MaxOutput}
+	}
+	r := newRenderer(t, w)
+	r.run = newRun(ctx, t.env)
+	if err := r.check(); err != nil {
+		return err
+	}
 	return r.render(c)
 }
 
 // Tree is the representation of a single parsed template.
 type Tree struct {
-	Name      string    // name of the template represented by the tree.
-	ParseName string    // name of the top-level template during parsing, for error messages.
-	Root      *ListNode // top-level root of the tree.
-	text      string    // text parsed to create the template (or its parent)
+	Name      string                // name of the template represented by the tree.
+	ParseName string                // name of the top-level template during parsing, for error messages.
+	Root      *ListNode             // top-level root of the tree.
+	Blocks    map[string]*BlockNode // named blocks defined anywhere in the tree.
+	text      string                // text parsed to create the template (or its parent)
 	// Parsing only; cleared after parse.
-	// funcs []map[string]interface{}
+	env *Environment // the environment, for validating filter names.
 	lex *lexer
 	// FIXME: the peek max is based on the way that the grammar works,
 	// but I don't know enough about the expression grammar i've loosely
 	// described to know if 3 is sufficient.
 	token     [3]item // three-token lookahead for parser.
 	peekCount int
-	stack     nodeStack
+	names     map[string]bool // names looked up in the macro being parsed.
 	// vars      []string // variables defined at the moment.
 }
 
@@ -135,12 +188,52 @@ func (t *Tree) Copy() *Tree {
 	if t == nil {
 		return nil
 	}
-	return &Tree{
+	n := &Tree{
 		Name:      t.Name,
 		ParseName: t.ParseName,
 		Root:      t.Root.CopyList(),
+		Blocks:    make(map[string]*BlockNode),
 		text:      t.text,
 	}
+	findBlocks(n.Root, n.Blocks)
+	return n
+}
+
+// findBlocks adds all of the blocks found in the body of n to blocks.
+func findBlocks(n Node, blocks map[string]*BlockNode) {
+	switch n := n.(type) {
+	case *ListNode:
+		for _, node := range n.Nodes {
+			findBlocks(node, blocks)
+		}
+	case *IfBlockNode:
+		for _, cond := range n.Conditionals {
+			findBlocks(cond.(*ConditionalNode).Body, blocks)
+		}
+		if n.Else != nil {
+			findBlocks(n.Else, blocks)
+		}
+	case *ForNode:
+		findBlocks(n.Body, blocks)
+		if n.Else != nil {
+			findBlocks(n.Else, blocks)
+		}
+	case *BlockNode:
+		blocks[n.Name] = n
+		findBlocks(n.Body, blocks)
+	case *FilterBlockNode:
+		findBlocks(n.Body, blocks)
+	case *AutoescapeNode:
+		findBlocks(n.Body, blocks)
+	case *SetNode:
+		if n.Body != nil {
+			findBlocks(n.Body, blocks)
+		}
+	case *MacroNode:
+		findBlocks(n.Body, blocks)
+	case *CallNode:
+		findBlocks(n.Body, blocks)
+	}
 }
 
 // next returns the next token.
@@ -216,35 +309,13 @@ func (t *Tree) expect(i itemType) (token item) {
 	return t.nextNonSpace()
 }
 
-// Collapse N nodes into one
-func (t *Tree) collapse(stack *nodeStack) Node {
-	if stack.len() < 2 {
-		return stack.pop()
-	}
-	rhs := stack.pop()
-	lhs := stack.pop()
-	switch lhs.(type) {
-	case *AddExpr:
-		lhs := lhs.(*AddExpr)
-		lhs.rhs = rhs
-		return lhs
-	case *MulExpr:
-		lhs := lhs.(*MulExpr)
-		lhs.rhs = rhs
-		return lhs
-	default:
-		stack.push(lhs)
-		stack.push(rhs)
-		return nil
-	}
-}
-
 // Parsing.
 
 // New allocates a new parse tree with the given name.
 func newTree(name string) *Tree {
 	return &Tree{
-		Name: name,
+		Name:   name,
+		Blocks: make(map[string]*BlockNode),
 	}
 }
 
@@ -303,6 +374,8 @@ func (t *Tree) startParse(lex *lexer) {
 // stopParse terminates parsing.
 func (t *Tree) stopParse() {
 	t.lex = nil
+	t.env = nil
+	t.names = nil
 }
 
 // Parse parses the template given the lexer.
@@ -347,11 +420,40 @@ func (t *Tree) parseNextNode() Node {
 			return t.parseVar()
 		case tokenText:
 			return t.parseText()
+		case tokenRawBegin:
+			return t.parseRaw()
+		case tokenError:
+			t.errorf("%s", t.next().val)
+		default:
+			t.unexpected(t.next(), "input")
 		}
 	}
 	return nil
 }
 
+// parseBody parses nodes until it encounters a block tag whose name is one of
+// ends, and returns the parsed nodes and the name of the tag that ended the
+// body.  The block begin and the tag name of the end tag are consumed, but
+// anything else in that tag (including the block end) is left to the caller.
+func (t *Tree) parseBody(ends ...string) (*ListNode, string) {
+	body := newList(t.peek().pos)
+	for {
+		name := t.nextBlockName()
+		for _, end := range ends {
+			if name == end {
+				t.expect(tokenBlockBegin)
+				t.nextNonSpace()
+				return body, name
+			}
+		}
+		n := t.parseNextNode()
+		if n == nil {
+			t.errorf("unexpected EOF, expected %s", strings.Join(ends, " or "))
+		}
+		body.append(n)
+	}
+}
+
 func (t *Tree) nextBlockName() string {
 	if t.peekNonSpace().typ != tokenBlockBegin {
 		return ""
@@ -372,6 +474,24 @@ func (t *Tree) parseText() Node {
 	return nil
 }
 
+// parseRaw parses a {% raw %}...{% endraw %} block, whose content is text.
+func (t *Tree) parseRaw() Node {
+	begin := t.next()
+	text := newText(begin.pos, "")
+	if t.peek().typ == tokenText {
+		token := t.next()
+		text = newText(token.pos, token.val)
+	}
+	switch token := t.next(); token.typ {
+	case tokenRawEnd:
+	case tokenError:
+		t.errorf("%s", token.val)
+	default:
+		t.unexpected(token, "raw block")
+	}
+	return text
+}
+
 // Skips over a comment;  comments are not represented in the final AST.
 func (t *Tree) skipComment() {
 	t.expect(tokenCommentBegin)
@@ -393,7 +513,7 @@ func (t *Tree) skipComment() {
 func (t *Tree) parseVar() Node {
 	token := t.expect(tokenVariableBegin)
 	expr := newVar(token.pos)
-	expr.Node = t.parseExpr(nil, tokenVariableEnd)
+	expr.Node = t.parseExpr(tokenVariableEnd)
 	t.expect(tokenVariableEnd)
 	return expr
 }
@@ -403,37 +523,288 @@ func (t *Tree) parseBlock() Node {
 	blockType := t.peekNonSpace()
 	switch blockType.val {
 	case "for":
+		t.backup2(start)
+		return t.parseFor()
 	case "if":
 		t.backup2(start)
 		return t.parseIf()
 	case "block":
+		t.backup2(start)
+		return t.parseNamedBlock()
 	case "extends":
+		t.backup2(start)
+		return t.parseExtends()
 	case "print":
 	case "macro":
+		t.backup2(start)
+		return t.parseMacro()
 	case "include":
+		t.backup2(start)
+		return t.parseInclude()
 	case "from":
+		t.backup2(start)
+		return t.parseFrom()
 	case "import":
+		t.backup2(start)
+		return t.parseImport()
 	case "call":
+		t.backup2(start)
+		return t.parseCallBlock()
+	case "filter":
+		t.backup2(start)
+		return t.parseFilterBlock()
 	case "set":
 		t.backup2(start)
 		return t.parseSet()
+	case "autoescape":
+		t.backup2(start)
+		return t.parseAutoescape()
 	default:
 		t.unexpected(blockType, "invalid block type")
 	}
 	return nil
 }
 
+// parseInclude parses an {% include %} tag, with optional `ignore missing`
+// and context modifiers.
+func (t *Tree) parseInclude() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	include := newInclude(begin.pos, t.parseExpr(tokenBlockEnd))
+	if token := t.peekNonSpace(); token.typ == tokenName && token.val == "ignore" {
+		t.nextNonSpace()
+		if missing := t.nextNonSpace(); missing.typ != tokenName || missing.val != "missing" {
+			t.unexpected(missing, "include")
+		}
+		include.IgnoreMissing = true
+	}
+	include.WithContext = t.parseContext(true)
+	t.expect(tokenBlockEnd)
+	return include
+}
+
+// parseImport parses an {% import module as name %} tag.
+func (t *Tree) parseImport() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	module := t.parseExpr(tokenBlockEnd)
+	if as := t.nextNonSpace(); as.typ != tokenName || as.val != "as" {
+		t.unexpected(as, "import")
+	}
+	imp := newImport(begin.pos, module, t.expect(tokenName).val)
+	imp.WithContext = t.parseContext(false)
+	t.expect(tokenBlockEnd)
+	return imp
+}
+
+// parseFrom parses a {% from module import name as alias, ... %} tag.
+func (t *Tree) parseFrom() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	from := newFrom(begin.pos, t.parseExpr(tokenBlockEnd))
+	if imp := t.nextNonSpace(); imp.typ != tokenName || imp.val != "import" {
+		t.unexpected(imp, "from")
+	}
+	for {
+		name := t.expect(tokenName)
+		as := name
+		if token := t.peekNonSpace(); token.typ == tokenName && token.val == "as" {
+			t.nextNonSpace()
+			as = t.expect(tokenName)
+		}
+		from.Imports = append(from.Imports, Import{name.val, as.val})
+		if t.peekNonSpace().typ != tokenComma {
+			break
+		}
+		t.nextNonSpace()
+	}
+	from.WithContext = t.parseContext(false)
+	t.expect(tokenBlockEnd)
+	return from
+}
+
+// parseContext parses an optional `with context` or `without context`, and
+// returns whether the context should be passed on, or def if neither is given.
+func (t *Tree) parseContext(def bool) bool {
+	token := t.peekNonSpace()
+	if token.typ != tokenName || (token.val != "with" && token.val != "without") {
+		return def
+	}
+	t.nextNonSpace()
+	if ctx := t.nextNonSpace(); ctx.typ != tokenName || ctx.val != "context" {
+		t.unexpected(ctx, token.val)
+	}
+	return token.val == "with"
+}
+
+// parseMacro parses a {% macro name(params) %}...{% endmacro %} definition.
+func (t *Tree) parseMacro() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	name := t.expect(tokenName)
+	macro := newMacro(begin.pos, name.val)
+	macro.Params, macro.Defaults = t.parseParams()
+	t.expect(tokenBlockEnd)
+	macro.Body, macro.Varargs, macro.Kwargs = t.parseMacroBody("endmacro")
+	t.expect(tokenBlockEnd)
+	return macro
+}
+
+// parseCallBlock parses a {% call(params) macro(args) %}...{% endcall %}
+// block.  The parameters of the block itself are optional.
+func (t *Tree) parseCallBlock() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	var params []string
+	var defaults []Node
+	if t.peekNonSpace().typ == tokenLparen {
+		params, defaults = t.parseParams()
+	}
+	expr := t.parseExpr(tokenBlockEnd)
+	call, ok := expr.(*CallExpr)
+	if !ok {
+		t.errorf("call block requires a call expression, not %s", expr)
+	}
+	block := newCallBlock(begin.pos, call)
+	block.Params, block.Defaults = params, defaults
+	t.expect(tokenBlockEnd)
+	block.Body, block.Varargs, block.Kwargs = t.parseMacroBody("endcall")
+	t.expect(tokenBlockEnd)
+	return block
+}
+
+// parseMacroBody parses the body of a macro or call block up to its end tag,
+// and returns it with whether it refers to `varargs` and `kwargs`.  Names
+// used in nested macros count as used in the macros around them.
+func (t *Tree) parseMacroBody(end string) (body *ListNode, varargs, kwargs bool) {
+	outer := t.names
+	t.names = make(map[string]bool)
+	body, _ = t.parseBody(end)
+	varargs, kwargs = t.names["varargs"], t.names["kwargs"]
+	if outer != nil {
+		for name := range t.names {
+			outer[name] = true
+		}
+	}
+	t.names = outer
+	return body, varargs, kwargs
+}
+
+// parseParams parses the parenthesized parameter list of a macro or call
+// block.  Parameters with default values must follow those without.
+func (t *Tree) parseParams() ([]string, []Node) {
+	t.expect(tokenLparen)
+	var params []string
+	var defaults []Node
+	for {
+		token := t.peekNonSpace()
+		switch token.typ {
+		case tokenRparen:
+			t.nextNonSpace()
+			return params, defaults
+		case tokenComma:
+			if len(params) == 0 {
+				t.unexpected(token, "parameter list")
+			}
+			t.nextNonSpace()
+			continue
+		}
+		name := t.expect(tokenName)
+		for _, p := range params {
+			if p == name.val {
+				t.errorf("duplicate parameter %s", name.val)
+			}
+		}
+		params = append(params, name.val)
+		if t.peekNonSpace().typ == tokenEq {
+			t.nextNonSpace()
+			defaults = append(defaults, t.parseExpr(tokenRparen))
+		} else if len(defaults) > 0 {
+			t.errorf("parameter %s without a default follows parameters with defaults", name.val)
+		}
+		if token := t.peekNonSpace(); token.typ != tokenComma && token.typ != tokenRparen {
+			t.unexpected(token, "parameter list")
+		}
+	}
+}
+
+// parseSet parses an assignment, which is either `{% set target = expr %}`
+// or a block assignment `{% set name|filters %}...{% endset %}`.
 func (t *Tree) parseSet() Node {
 	start := t.expect(tokenBlockBegin)
-	set := t.nextNonSpace()
-	if set.val != "set" {
-		t.unexpected(set, "set")
+	t.nextNonSpace()
+	var target Node
+	name := t.expect(tokenName)
+	if t.peekNonSpace().typ == tokenDot {
+		t.nextNonSpace()
+		attr := t.expect(tokenName)
+		target = newAttrExpr(newLookup(name.pos, name.val), attr.val)
+	} else {
+		t.backup2(name)
+		target = t.parseTarget()
+	}
+
+	if token := t.peekNonSpace(); token.typ != tokenEq {
+		lookup, ok := target.(*LookupNode)
+		if !ok {
+			t.unexpected(token, "set")
+		}
+		set := newSet(start.pos, lookup, nil)
+		for t.peekNonSpace().typ == tokenPipe {
+			t.nextNonSpace()
+			set.Filters = append(set.Filters, t.parseFilter(nil))
+		}
+		t.expect(tokenBlockEnd)
+		set.Body, _ = t.parseBody("endset")
+		t.expect(tokenBlockEnd)
+		return set
 	}
-	name := t.lookupExpr()
 	t.expect(tokenEq)
-	val := t.parseSingleExpr(nil, tokenBlockEnd)
+	val := t.parseExpr(tokenBlockEnd)
+	// a comma separated list of values is a tuple, eg. `set a, b = b, a`
+	if t.peekNonSpace().typ == tokenComma {
+		tuple := newTuple(val.Position())
+		tuple.append(val)
+		for t.peekNonSpace().typ == tokenComma {
+			t.nextNonSpace()
+			tuple.append(t.parseExpr(tokenBlockEnd))
+		}
+		val = tuple
+	}
 	t.expect(tokenBlockEnd)
-	return newSet(start.pos, name, val)
+	return newSet(start.pos, target, val)
+}
+
+// parseNamedBlock parses a {% block name %}...{% endblock %}.  Block names
+// must be unique within a template.
+func (t *Tree) parseNamedBlock() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	name := t.expect(tokenName)
+	if _, ok := t.Blocks[name.val]; ok {
+		t.errorf("block %q defined twice", name.val)
+	}
+	t.expect(tokenBlockEnd)
+	block := newBlock(begin.pos, name.val)
+	t.Blocks[name.val] = block
+	block.Body, _ = t.parseBody("endblock")
+	if end := t.nextNonSpace(); end.typ == tokenName {
+		if end.val != name.val {
+			t.errorf("endblock %q does not match block %q", end.val, name.val)
+		}
+	} else {
+		t.backup()
+	}
+	t.expect(tokenBlockEnd)
+	return block
+}
+
+func (t *Tree) parseExtends() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	node := newExtends(begin.pos, t.parseExpr(tokenBlockEnd))
+	t.expect(tokenBlockEnd)
+	return node
 }
 
 func (t *Tree) parseIf() Node {
@@ -445,94 +816,127 @@ func (t *Tree) parseIf() Node {
 	node := newIf(begin.pos)
 
 	cond := newIfCond(begin.pos)
-	cond.Guard = t.parseSingleExpr(nil, tokenBlockEnd)
-	t.expect(tokenBlockEnd)
-	body := newList(t.peek().pos)
-	// we need some kind of parseBody here
-
-	inElse := false
 	for {
-		block := t.nextBlockName()
-		switch block {
+		cond.Guard = t.parseExpr(tokenBlockEnd)
+		t.expect(tokenBlockEnd)
+		body, end := t.parseBody("elif", "else", "endif")
+		cond.Body = body
+		node.Conditionals = append(node.Conditionals, cond)
+		switch end {
 		case "elif":
-			if inElse {
-				panic("Elif encountered after previous else")
-			}
-			// set the body for the previous conditional and append it
-			cond.Body = body
-			node.Conditionals = append(node.Conditionals, cond)
-			// create a new elif conditional
-			cond := newElifCond(t.next().pos)
-			t.nextNonSpace()
-			cond.Guard = t.parseSingleExpr(nil, tokenBlockEnd)
-			t.expect(tokenBlockEnd)
-			body = newList(t.peek().pos)
+			cond = newElifCond(t.peek().pos)
 		case "else":
-			if inElse {
-				panic("Else encountered after previous else")
-			}
-			cond.Body = body
-			node.Conditionals = append(node.Conditionals, cond)
-			t.expect(tokenBlockBegin)
-			t.nextNonSpace()
 			t.expect(tokenBlockEnd)
-			body = newList(t.peek().pos)
-			inElse = true
+			node.Else, _ = t.parseBody("endif")
+			t.expect(tokenBlockEnd)
+			return node
 		case "endif":
-			// eat the endif and return successfully
-			t.expect(tokenBlockBegin)
-			t.nextNonSpace()
 			t.expect(tokenBlockEnd)
-			if inElse {
-				node.Else = body
-			} else {
-				node.Conditionals = append(node.Conditionals, cond)
-			}
 			return node
-		default:
-			n := t.parseNextNode()
-			if n == nil {
-				panic("EOF inside an If")
-				// EOF inside an If
-				return nil
-			}
-			body.append(n)
 		}
 	}
-	fmt.Println(t.peekNonSpace())
-	return nil
+}
+
+func (t *Tree) parseFor() Node {
+	begin := t.expect(tokenBlockBegin)
+	fortok := t.nextNonSpace()
+	if fortok.val != "for" {
+		t.unexpected(fortok, "for")
+	}
+	node := newFor(begin.pos)
+	node.ForExpr = t.parseTarget()
+	if in := t.nextNonSpace(); in.typ != tokenName || in.val != "in" {
+		t.unexpected(in, "for")
+	}
+	node.InExpr = t.parseExpr(tokenBlockEnd)
+	t.expect(tokenBlockEnd)
+
+	body, end := t.parseBody("else", "endfor")
+	t.expect(tokenBlockEnd)
+	node.Body = body
+	if end == "else" {
+		node.Else, _ = t.parseBody("endfor")
+		t.expect(tokenBlockEnd)
+	}
+	return node
+}
+
+// parseTarget parses the target of an assignment, which is either a single
+// name or a comma separated list of names to unpack a sequence into.
+func (t *Tree) parseTarget() Node {
+	name := t.expect(tokenName)
+	target := Node(newLookup(name.pos, name.val))
+	if t.peekNonSpace().typ != tokenComma {
+		return target
+	}
+	tuple := newTuple(name.pos)
+	tuple.append(target)
+	for t.peekNonSpace().typ == tokenComma {
+		t.nextNonSpace()
+		name = t.expect(tokenName)
+		tuple.append(newLookup(name.pos, name.val))
+	}
+	return tuple
 }
 
 // parse a single expression simple expression.  This is a lookup, literal, or
-// index expression.
-func (t *Tree) parseSingleExpr(stack *nodeStack, terminator itemType) Node {
+// index expression, optionally followed by any number of filters and tests.
+func (t *Tree) parseSingleExpr(terminator itemType) Node {
+	n := t.parseOperand(terminator)
+	for {
+		switch token := t.peekNonSpace(); {
+		case token.typ == tokenPipe:
+			t.nextNonSpace()
+			n = t.parseFilter(n)
+		case token.typ == tokenName && token.val == "is":
+			t.nextNonSpace()
+			n = t.parseTest(n, terminator)
+		default:
+			return n
+		}
+	}
+}
+
+// parse an operand;  a lookup, literal, index, or parenthesized expression.
+func (t *Tree) parseOperand(terminator itemType) Node {
 	token := t.peekNonSpace()
 	switch token.typ {
 	case terminator:
 		t.unexpected(token, "expected expression")
 	case tokenName:
+		switch token.val {
+		case "and", "or", "not", "in", "is":
+			t.unexpected(token, "expression")
+		}
 		return t.lookupExpr()
 	case tokenLparen:
-		t.expect(tokenLparen)
-		return t.parseExpr(nil, tokenRparen)
+		return t.maybeIndexExpr(t.parenExpr())
 	case tokenLbrace:
 		return t.mapExpr()
 	case tokenLbracket:
 		return t.listExpr()
-	case tokenFloat, tokenInteger, tokenString, tokenBool:
+	case tokenString:
+		// strings may be subscripted, eg. "abc"[::-1]
+		return t.maybeIndexExpr(t.literalExpr())
+	case tokenFloat, tokenInteger, tokenBool, tokenNone:
 		return t.literalExpr()
 	case tokenAdd, tokenSub:
 		unary := t.nextNonSpace()
-		value := t.parseSingleExpr(nil, terminator)
-		switch value.Type() {
-		case NodeUnary:
+		value := t.parseOperand(terminator)
+		// numeric literals are negated at parse time
+		switch v := value.(type) {
+		case *UnaryNode:
 			t.unexpected(unary, "expression")
-		case NodeFloat:
-			// FIXME: apply unary oper to value
-			return value
-		case NodeInteger:
-			// FIXME: apply unary oper to value
-			return value
+		case *FloatNode:
+			if unary.typ == tokenSub {
+				v.Value = -v.Value
+			}
+			return v
+		case *IntegerNode:
+			if unary.typ == tokenSub {
+				v.Value = -v.Value
+			}
+			return v
 		default:
 			return newUnaryNode(value, unary)
 		}
@@ -542,72 +946,89 @@ func (t *Tree) parseSingleExpr(stack *nodeStack, terminator itemType) Node {
 	panic("unexpected")
 }
 
-// Parses an expression until it hits a terminator.  An expression one of
-// a few types of expressions, some of which can contain Expressions
-// themselves.  A stack is passed with each callframe.
-func (t *Tree) parseExpr(stack *nodeStack, terminator itemType) Node {
-	token := t.peekNonSpace()
-	if stack == nil {
-		stack = newStack(token.pos)
-	}
-	stack.push(t.parseSingleExpr(stack, terminator))
+// Parses an expression.  Expressions end at the first token which cannot
+// continue them, which the caller expects to be terminator.
+func (t *Tree) parseExpr(terminator itemType) Node {
+	return t.parseBinaryExpr(1, terminator)
+}
+
+// parseBinaryExpr parses an expression made up of binary operators with a
+// precedence of at least prec.  Operators of higher precedence bind more
+// tightly, and operators of the same precedence are left associative, except
+// for `**` which is right associative.
+// Comparisons chain, so that `a < b < c` means `a < b and b < c`.
+func (t *Tree) parseBinaryExpr(prec int, terminator itemType) Node {
+	lhs := t.parseNotExpr(terminator)
+	var chain *CompareExpr
 	for {
-		token = t.peekNonSpace()
-		switch token.typ {
-		case terminator:
-			if stack.len() == 0 {
-				fmt.Printf("Stack: %#v\n", stack)
-				t.unexpected(token, "zero length expression")
-			}
-			return stack.pop()
-		case tokenAdd, tokenSub:
-			// consume the plus token
-			t.nextNonSpace()
-			// if the stack isn't empty, the previous expression is the lhs for the
-			// upcoming expression:
-			if stack.len() > 0 {
-				rhs := t.parseExpr(stack, terminator)
-				// if the token after the rhs expression is an operator with greater precedence,
-				// push rhs to the stack and continue going from there
-				if tok := t.peekNonSpace(); tok.precedence() > token.precedence() {
-					stack.push(rhs)
-					return t.parseExpr(stack, terminator)
-				} else {
-					// otherwise, take lhs off the stack and create a new AddExpr
-					lhs := stack.pop()
-					stack.push(newAddExpr(lhs, rhs, token))
-				}
-			}
-		case tokenMul, tokenMod, tokenDiv, tokenFloordiv:
-			t.nextNonSpace()
-			if stack.len() > 0 {
-				lhs := stack.pop()
-				rhs := t.parseSingleExpr(stack, terminator)
-				// we know this strongly binds ltr so no need to peek
-				stack.push(newMulExpr(lhs, rhs, token))
-			} else {
-				t.unexpected(token, "binary op")
-			}
-		case tokenComma:
-			// if we are terminating a map, param list, or list, return the expression
-			if terminator == tokenRbracket || terminator == tokenRparen || terminator == tokenRbrace {
-				if stack.len() != 1 {
-					t.unexpected(token, "expression")
-				}
-				return stack.pop()
-			}
+		op := t.peekOperator()
+		if op.precedence() < prec {
+			return lhs
+		}
+		t.nextOperator()
+		next := op.precedence() + 1
+		if op.typ == tokenPow {
+			next = op.precedence()
+		}
+		rhs := t.parseBinaryExpr(next, terminator)
+		switch {
+		case op.isComparison() && chain != nil:
+			chain.append(op, rhs)
+		case op.isComparison():
+			chain = newCompareExpr(lhs)
+			chain.append(op, rhs)
+			lhs = chain
+		case op.typ == tokenAnd || op.typ == tokenOr || op.val == "and" || op.val == "or":
+			lhs = newLogicalExpr(lhs, rhs, op)
+		case op.typ == tokenTilde:
+			lhs = newConcatExpr(lhs, rhs, op)
+		case op.typ == tokenAdd || op.typ == tokenSub:
+			lhs = newAddExpr(lhs, rhs, op)
 		default:
-			t.unexpected(token, "expression")
+			lhs = newMulExpr(lhs, rhs, op)
+		}
+	}
+}
+
+// parseNotExpr parses a boolean negation with `not` or `!`, which binds less
+// tightly than comparisons, or an operand.
+func (t *Tree) parseNotExpr(terminator itemType) Node {
+	token := t.peekNonSpace()
+	if token.typ == tokenNot || token.typ == tokenName && token.val == "not" {
+		t.nextNonSpace()
+		token.typ = tokenNot
+		return newUnaryNode(t.parseBinaryExpr(precedenceCompare, terminator), token)
+	}
+	return t.parseSingleExpr(terminator)
+}
+
+// peekOperator returns the next token if it is a binary operator.  The two
+// word operator `not in` is returned as a single token.
+func (t *Tree) peekOperator() item {
+	token := t.peekNonSpace()
+	if token.typ == tokenName && token.val == "not" {
+		not := t.nextNonSpace()
+		next := t.peekNonSpace()
+		t.backup2(not)
+		if next.typ == tokenName && next.val == "in" {
+			token.val = "not in"
 		}
 	}
-	panic("required expr but got none")
+	return token
+}
+
+// nextOperator consumes the operator returned by peekOperator.
+func (t *Tree) nextOperator() {
+	if token := t.nextNonSpace(); token.typ == tokenName && token.val == "not" {
+		t.nextNonSpace()
+	}
 }
 
 // in this sense, a literal is a simple lexer-level literal
 func (t *Tree) literalExpr() Node {
 	token := t.nextNonSpace()
 	switch token.typ {
-	case tokenFloat, tokenInteger, tokenString, tokenBool:
+	case tokenFloat, tokenInteger, tokenString, tokenBool, tokenNone:
 		return newLiteral(token.pos, token.typ, token.val)
 	default:
 		t.unexpected(token, "literal")
@@ -617,28 +1038,215 @@ func (t *Tree) literalExpr() Node {
 
 func (t *Tree) lookupExpr() Node {
 	name := t.nextNonSpace()
+	if t.names != nil {
+		t.names[name.val] = true
+	}
 	return t.maybeIndexExpr(newLookup(name.pos, name.val))
 }
 
-// determine if there is one or more index expressions on the end
-// of the expression passed in.  If there is, return a lookup expr,
-// otherwise, return the original node
+// subscriptExpr parses a subscript of n, which is either an index like
+// `n[0]` or a slice like `n[1:-1:2]`, where each part of a slice is optional.
+func (t *Tree) subscriptExpr(n Node) Node {
+	t.expect(tokenLbracket)
+	var parts [3]Node
+	colons := 0
+	for {
+		token := t.peekNonSpace()
+		switch token.typ {
+		case tokenRbracket:
+			t.nextNonSpace()
+			switch {
+			case colons > 0:
+				return newSliceExpr(n, parts[0], parts[1], parts[2])
+			case parts[0] == nil:
+				t.unexpected(token, "subscript")
+			}
+			return newIndexExpr(n, parts[0])
+		case tokenColon:
+			if colons == 2 {
+				t.unexpected(token, "slice")
+			}
+			t.nextNonSpace()
+			colons++
+		default:
+			if parts[colons] != nil {
+				t.unexpected(token, "subscript")
+			}
+			parts[colons] = t.parseExpr(tokenRbracket)
+		}
+	}
+}
+
+// determine if there is one or more index, attribute or call expressions
+// on the end of the expression passed in.  If there is, return the
+// resulting expr, otherwise, return the original node
 func (t *Tree) maybeIndexExpr(n Node) Node {
 	for {
 		tok := t.peekNonSpace()
-		if tok.typ == tokenLbrace {
+		switch tok.typ {
+		case tokenLbracket:
+			n = t.subscriptExpr(n)
+		case tokenDot:
 			t.nextNonSpace()
-			index := t.parseExpr(nil, tokenRbrace)
-			n = newIndexExpr(n, index)
-		} else {
+			name := t.next()
+			if name.typ != tokenName {
+				t.unexpected(name, "attribute")
+			}
+			n = newAttrExpr(n, name.val)
+		case tokenLparen:
+			n = t.callExpr(n)
+		default:
 			return n
 		}
 	}
 }
 
+// parse the argument list of a call to fn.
+func (t *Tree) callExpr(fn Node) Node {
+	call := newCallExpr(fn)
+	call.Args, call.Kwargs = t.parseArgs()
+	return call
+}
+
+// parse the application of a filter to value, ie. the `name(args)` part of
+// `value|name(args)`.  Unknown filter names are an error.
+func (t *Tree) parseFilter(value Node) *FilterExpr {
+	name := t.expect(tokenName)
+	if _, ok := t.env.Filters[name.val]; !ok {
+		t.errorf("no filter named %q", name.val)
+	}
+	filter := newFilterExpr(name.pos, value, name.val)
+	if value != nil {
+		filter.Pos = value.Position()
+	}
+	if t.peekNonSpace().typ == tokenLparen {
+		filter.Args, filter.Kwargs = t.parseArgs()
+	}
+	return filter
+}
+
+// parse the application of a test to value, ie. the `not name(args)` part
+// of `value is not name(args)`.  A test with a single argument may also be
+// written without parentheses, as in `n is divisibleby 3`.
+func (t *Tree) parseTest(value Node, terminator itemType) *TestExpr {
+	name := t.nextNonSpace()
+	negated := name.typ == tokenName && name.val == "not"
+	if negated {
+		name = t.nextNonSpace()
+	}
+	// the tests `true`, `false` and `none` are lexed as literals
+	if name.typ != tokenName && name.typ != tokenBool && name.typ != tokenNone {
+		t.unexpected(name, "test")
+	}
+	if _, ok := t.env.Tests[name.val]; !ok {
+		t.errorf("no test named %q", name.val)
+	}
+	test := newTestExpr(value.Position(), value, name.val, negated)
+	switch token := t.peekNonSpace(); token.typ {
+	case tokenLparen:
+		test.Args, test.Kwargs = t.parseArgs()
+	case tokenInteger, tokenFloat, tokenString, tokenBool, tokenNone, tokenLbracket, tokenLbrace:
+		test.Args = []Node{t.parseOperand(terminator)}
+	case tokenName:
+		switch token.val {
+		case "and", "or", "else", "if", "is", "in", "not":
+		default:
+			test.Args = []Node{t.parseOperand(terminator)}
+		}
+	}
+	return test
+}
+
+// parse a parenthesized argument list made up of positional arguments
+// followed by keyword arguments.
+func (t *Tree) parseArgs() ([]Node, []*KeywordArg) {
+	t.expect(tokenLparen)
+	var args []Node
+	var kwargs []*KeywordArg
+	for {
+		token := t.peekNonSpace()
+		switch token.typ {
+		case tokenRparen:
+			t.nextNonSpace()
+			return args, kwargs
+		case tokenComma:
+			if len(args)+len(kwargs) == 0 {
+				t.unexpected(token, "argument list")
+			}
+			t.nextNonSpace()
+			continue
+		case tokenName:
+			name := t.nextNonSpace()
+			if t.peekNonSpace().typ == tokenEq {
+				t.nextNonSpace()
+				for _, kw := range kwargs {
+					if kw.Name == name.val {
+						t.errorf("duplicate keyword argument %s", name.val)
+					}
+				}
+				kwargs = append(kwargs, newKeywordArg(name.pos, name.val, t.parseExpr(tokenRparen)))
+				continue
+			}
+			t.backup2(name)
+		}
+		if len(kwargs) > 0 {
+			t.errorf("positional argument follows keyword argument")
+		}
+		args = append(args, t.parseExpr(tokenRparen))
+	}
+}
+
+// parse a {% filter %}...{% endfilter %} block.
+func (t *Tree) parseFilterBlock() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	block := newFilterBlock(begin.pos)
+	block.Filters = append(block.Filters, t.parseFilter(nil))
+	for t.peekNonSpace().typ == tokenPipe {
+		t.nextNonSpace()
+		block.Filters = append(block.Filters, t.parseFilter(nil))
+	}
+	t.expect(tokenBlockEnd)
+	block.Body, _ = t.parseBody("endfilter")
+	t.expect(tokenBlockEnd)
+	return block
+}
+
+// parseAutoescape parses an {% autoescape expr %}...{% endautoescape %} block.
+func (t *Tree) parseAutoescape() Node {
+	begin := t.expect(tokenBlockBegin)
+	t.nextNonSpace()
+	block := newAutoescape(begin.pos, t.parseExpr(tokenBlockEnd))
+	t.expect(tokenBlockEnd)
+	block.Body, _ = t.parseBody("endautoescape")
+	t.expect(tokenBlockEnd)
+	return block
+}
+
+// parenExpr parses a parenthesized expression, or a tuple literal if the
+// parentheses are empty or contain a comma, eg. `()`, `(a,)` or `(a, b)`.
 func (t *Tree) parenExpr() Node {
-	t.next()
-	return nil
+	tok := t.expect(tokenLparen)
+	tuple := newTuple(tok.pos)
+	if t.peekNonSpace().typ == tokenRparen {
+		t.nextNonSpace()
+		return tuple
+	}
+	n := t.parseExpr(tokenRparen)
+	if t.peekNonSpace().typ != tokenComma {
+		t.expect(tokenRparen)
+		return n
+	}
+	tuple.append(n)
+	for t.peekNonSpace().typ == tokenComma {
+		t.nextNonSpace()
+		if t.peekNonSpace().typ == tokenRparen {
+			break
+		}
+		tuple.append(t.parseExpr(tokenRparen))
+	}
+	t.expect(tokenRparen)
+	return tuple
 }
 
 func (t *Tree) mapExpr() Node {
@@ -664,12 +1272,12 @@ func (t *Tree) mapExpr() Node {
 
 // parse a single map element;  assume that the next token is not '}'
 func (t *Tree) mapElem() Node {
-	key := t.parseExpr(nil, tokenColon)
+	key := t.parseExpr(tokenColon)
 	colon := t.nextNonSpace()
 	if colon.typ != tokenColon {
 		t.unexpected(colon, "map key expr")
 	}
-	val := t.parseExpr(nil, tokenRbrace)
+	val := t.parseExpr(tokenRbrace)
 	return newMapElem(key, val)
 
 }
@@ -689,7 +1297,7 @@ func (t *Tree) listExpr() Node {
 			t.next()
 			return t.maybeIndexExpr(list)
 		default:
-			elem := t.parseExpr(nil, tokenRbrace)
+			elem := t.parseExpr(tokenRbracket)
 			list.append(elem)
 		}
 	}
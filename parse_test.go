@@ -45,6 +45,46 @@ func (n NodeType) String() string {
 		return "NodeElseIf"
 	case NodeFor:
 		return "NodeFor"
+	case NodeAttr:
+		return "NodeAttr"
+	case NodeCall:
+		return "NodeCall"
+	case NodeTuple:
+		return "NodeTuple"
+	case NodeBlock:
+		return "NodeBlock"
+	case NodeExtends:
+		return "NodeExtends"
+	case NodeFilter:
+		return "NodeFilter"
+	case NodeKeyword:
+		return "NodeKeyword"
+	case NodeFilterBlock:
+		return "NodeFilterBlock"
+	case NodeTest:
+		return "NodeTest"
+	case NodeCompare:
+		return "NodeCompare"
+	case NodeLogical:
+		return "NodeLogical"
+	case NodeConcat:
+		return "NodeConcat"
+	case NodeSlice:
+		return "NodeSlice"
+	case NodeMacro:
+		return "NodeMacro"
+	case NodeCallBlock:
+		return "NodeCallBlock"
+	case NodeInclude:
+		return "NodeInclude"
+	case NodeImport:
+		return "NodeImport"
+	case NodeFrom:
+		return "NodeFrom"
+	case NodeAutoescape:
+		return "NodeAutoescape"
+	case NodeNone:
+		return "NodeNone"
 	default:
 		return "Unknown Type"
 	}
@@ -93,7 +133,7 @@ func spewTree(n Node, indent string) {
 		spewTree(n.Value, indent+"  val:")
 		fmt.Printf("%s}\n", indent)
 	default:
-		fmt.Printf(indent)
+		fmt.Print(indent)
 		spew.Dump(n)
 	}
 }
@@ -132,8 +172,15 @@ func (p *parsetest) Test(input string, test parseTest) {
 			}
 		}
 	*/
-	if err != nil && !test.isError {
-		t.Errorf("Unexpected error: %s\n", err)
+	if err != nil {
+		if !test.isError {
+			t.Errorf("Unexpected error: %s\n", err)
+		}
+		return
+	}
+	if test.isError {
+		t.Errorf("Expected error parsing %s\n", input)
+		return
 	}
 
 	if len(test.nodeTypes) != len(tree.Root.Nodes) {
@@ -190,13 +237,197 @@ func TestParser(t *testing.T) {
 		parseTest{nodeTypes: []NodeType{NodeVar}},
 	)
 
+	tester.Test(
+		`{{ [1, [2, 3], {"a": (4, 5)}] }}{{ () }}{{ (1,) }}{{ (1, 2,)[0] }}`,
+		parseTest{nodeTypes: []NodeType{NodeVar, NodeVar, NodeVar, NodeVar}},
+	)
+
+	tester.Test(
+		`{{ (1, 2 }}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{{ f() }}{{ f(1, b=2) }}{{ obj.method(x)(y).z }}`,
+		parseTest{nodeTypes: []NodeType{NodeVar, NodeVar, NodeVar}},
+	)
+
+	tester.Test(
+		`{{ f(a=1, 2) }}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{{ f(a=1, a=2) }}`,
+		parseTest{isError: true},
+	)
+
 	tester.Test(
 		`{% set foo = 1 %}`,
 		parseTest{nodeTypes: []NodeType{NodeSet}},
 	)
 
+	tester.Test(
+		`{% set a, b = 1, 2 %}{% set ns.x = a %}{% set body|upper %}text{% endset %}`,
+		parseTest{nodeTypes: []NodeType{NodeSet, NodeSet, NodeSet}},
+	)
+
+	tester.Test(
+		`{% set a, b %}text{% endset %}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% set body %}text`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% macro m(a, b=1) %}{{ a }}{% endmacro %}{% call(x) m(1) %}{{ x }}{% endcall %}{% call m() %}{% endcall %}`,
+		parseTest{nodeTypes: []NodeType{NodeMacro, NodeCallBlock, NodeCallBlock}},
+	)
+
+	tester.Test(
+		`{% macro m(a=1, b) %}{% endmacro %}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% macro m(a, a) %}{% endmacro %}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% call m %}{% endcall %}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% include "a.html" %}{% include ["a", b] ignore missing %}{% include x without context %}{% include x ignore missing with context %}`,
+		parseTest{nodeTypes: []NodeType{NodeInclude, NodeInclude, NodeInclude, NodeInclude}},
+	)
+
+	tester.Test(
+		`{% include "a.html" ignore %}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% include "a.html" with %}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% import "forms.html" as forms %}{% import name as f with context %}{% from "forms.html" import input as field, textarea %}{% from f import a without context %}`,
+		parseTest{nodeTypes: []NodeType{NodeImport, NodeImport, NodeFrom, NodeFrom}},
+	)
+
+	tester.Test(
+		`{% autoescape false %}{{ x }}{% endautoescape %}{% autoescape on %}{% endautoescape %}`,
+		parseTest{nodeTypes: []NodeType{NodeAutoescape, NodeAutoescape}},
+	)
+
+	tester.Test(
+		`{% autoescape true %}{{ x }}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% import "forms.html" %}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% from "forms.html" import %}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% from "forms.html" import a as %}`,
+		parseTest{isError: true},
+	)
+
 	tester.Test(
 		`{% if true %}something{% else %}something else{% endif %}`,
 		parseTest{nodeTypes: []NodeType{NodeIf}},
 	)
+
+	tester.Test(
+		`{% for x in items %}{{ x }}{% else %}none{% endfor %}`,
+		parseTest{nodeTypes: []NodeType{NodeFor}},
+	)
+
+	tester.Test(
+		`{% for k, v in items %}{{ loop.cycle(k, v) }}{% endfor %}!`,
+		parseTest{nodeTypes: []NodeType{NodeFor, NodeText}},
+	)
+
+	tester.Test(
+		`{% for x in items %}{{ x }}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{{ name|upper }}{% filter upper %}text{% endfilter %}`,
+		parseTest{nodeTypes: []NodeType{NodeVar, NodeFilterBlock}},
+	)
+
+	tester.Test(
+		`{{ name|nofilter }}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{{ -2 ** 3 ** 2 ~ "x" }}{{ 7 % 2 }}`,
+		parseTest{nodeTypes: []NodeType{NodeVar, NodeVar}},
+	)
+
+	tester.Test(
+		`{% if a and not b or 1 < c <= 3 %}{% endif %}{{ x not in y }}`,
+		parseTest{nodeTypes: []NodeType{NodeIf, NodeVar}},
+	)
+
+	tester.Test(
+		`{{ x is not defined }}{{ n|length is divisibleby 3 }}`,
+		parseTest{nodeTypes: []NodeType{NodeVar, NodeVar}},
+	)
+
+	tester.Test(
+		`{{ items[0] }}{{ items[1:-1:2] }}{{ name[:3] }}{{ m["k"][::-1] }}`,
+		parseTest{nodeTypes: []NodeType{NodeVar, NodeVar, NodeVar, NodeVar}},
+	)
+
+	tester.Test(
+		`{{ items[] }}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{{ items[1:2:3:4] }}`,
+		parseTest{isError: true},
+	)
+
+	tester.Test(
+		`{% extends "base.html" %}{% block a %}{% block b %}b{% endblock b %}{% endblock %}`,
+		parseTest{nodeTypes: []NodeType{NodeExtends, NodeBlock}},
+	)
+}
+
+func TestTreeCopy(t *testing.T) {
+	source := `{% filter upper %}{% block a %}{% endblock %}{% endfilter %}{% autoescape false %}{% block b %}{% endblock %}{% endautoescape %}` +
+		`{% set x %}{% block c %}{% endblock %}{% endset %}{% macro m() %}{% block d %}{% endblock %}{% endmacro %}` +
+		`{% call m() %}{% block e %}{% endblock %}{% endcall %}{% if x %}{% for y in x %}{% block f %}{% endblock %}{% endfor %}{% endif %}`
+	tpl, err := NewEnvironment().ParseString(source, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := tpl.base.Copy()
+	if tree.Root.String() != tpl.base.Root.String() {
+		t.Errorf("expected copy %s, got %s", tpl.base.Root, tree.Root)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		if tree.Blocks[name] == nil {
+			t.Errorf("block %s missing from copy", name)
+		}
+	}
 }
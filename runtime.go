@@ -0,0 +1,206 @@
+package jigo
+
+import "fmt"
+
+// This file contains the objects which are created by templates at render
+// time, like the `loop` variable available inside of for loops.
+
+// attrGetter is implemented by runtime objects which expose attributes to
+// templates without going through reflection.
+type attrGetter interface {
+	getattr(name string) (interface{}, bool)
+}
+
+// loopContext is the `loop` variable available in the body of a for loop.
+// Its items are fetched one at a time, so that loops over channels run as
+// items are received.  The item after the current one is only fetched when
+// the template asks for it, and the length of a loop over a channel is only
+// known once the channel has been closed.
+type loopContext struct {
+	next     func() (interface{}, bool, error)
+	index0   int
+	length   int // the number of items, or -1 if it is not known yet
+	item     interface{}
+	previtem interface{}
+	peeked   bool        // whether the item after the current one was fetched
+	nextitem interface{} // the item after the current one, if peeked
+	err      error       // the error fetching the next item, if any
+}
+
+// newLoopContext returns a loop over the items yielded by next, of which
+// there are length, or -1 if that is not known in advance.
+func newLoopContext(next func() (interface{}, bool, error), length int) *loopContext {
+	return &loopContext{next: next, index0: -1, length: length}
+}
+
+// peek fetches the item after the current one if it has not been fetched
+// already, and returns whether there is one.
+func (l *loopContext) peek() (bool, error) {
+	if !l.peeked {
+		item, ok, err := l.next()
+		if err != nil {
+			return false, err
+		}
+		l.peeked, l.nextitem = true, item
+		if !ok {
+			l.length = l.index0 + 1
+		}
+	}
+	return l.length != l.index0+1, nil
+}
+
+// advance moves the loop on to its next item, and returns false if there
+// are no more items.
+func (l *loopContext) advance() (bool, error) {
+	more, err := l.peek()
+	if err != nil || !more {
+		return false, err
+	}
+	l.peeked = false
+	l.previtem, l.item = l.item, l.nextitem
+	l.index0++
+	return true, nil
+}
+
+// lookahead peeks at the item after the current one for an attribute of the
+// loop.  Errors are kept to be returned once the loop body is rendered.
+func (l *loopContext) lookahead() bool {
+	more, err := l.peek()
+	if err != nil && l.err == nil {
+		l.err = err
+	}
+	return more
+}
+
+func (l *loopContext) getattr(name string) (interface{}, bool) {
+	switch name {
+	case "index":
+		return l.index0 + 1, true
+	case "index0":
+		return l.index0, true
+	case "revindex", "revindex0", "length":
+		if l.length < 0 {
+			l.lookahead()
+		}
+		if l.length < 0 {
+			return undefined{"loop." + name}, true
+		}
+		switch name {
+		case "revindex":
+			return l.length - l.index0, true
+		case "revindex0":
+			return l.length - l.index0 - 1, true
+		}
+		return l.length, true
+	case "first":
+		return l.index0 == 0, true
+	case "last":
+		return !l.lookahead(), true
+	case "previtem":
+		return l.previtem, true
+	case "nextitem":
+		if !l.lookahead() {
+			return nil, true
+		}
+		return l.nextitem, true
+	case "cycle":
+		return builtin{l.cycle}, true
+	}
+	return nil, false
+}
+
+// cycle returns one of its arguments, cycling through them on each iteration.
+func (l *loopContext) cycle(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("loop.cycle requires at least one argument")
+	}
+	return args[l.index0%len(args)], nil
+}
+
+func (l *loopContext) String() string {
+	if l.length < 0 {
+		return fmt.Sprintf("<loop %d>", l.index0+1)
+	}
+	return fmt.Sprintf("<loop %d/%d>", l.index0+1, l.length)
+}
+
+// namespace is an object created by `namespace()` whose attributes can be
+// assigned with `{% set ns.attr = value %}`.  Unlike other assignments,
+// these are visible outside of the loop or block which made them.
+type namespace struct {
+	attrs map[string]interface{}
+}
+
+// newNamespace is the `namespace` global.  Its attributes are initialised
+// from any maps passed as positional arguments and then from its keyword
+// arguments.
+func newNamespace(args Args, kwargs Kwargs) (*namespace, error) {
+	ns := &namespace{attrs: make(map[string]interface{})}
+	for _, arg := range args {
+		m, ok := arg.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("namespace arguments must be maps, not %T", arg)
+		}
+		for k, v := range m {
+			ns.attrs[k] = v
+		}
+	}
+	for k, v := range kwargs {
+		ns.attrs[k] = v
+	}
+	return ns, nil
+}
+
+func (n *namespace) getattr(name string) (interface{}, bool) {
+	v, ok := n.attrs[name]
+	return v, ok
+}
+
+func (n *namespace) String() string {
+	return fmt.Sprintf("<namespace %v>", n.attrs)
+}
+
+// module is a template imported with {% import %}.  Its attributes are the
+// macros and variables defined at the top level of the template, except for
+// those whose names start with an underscore.
+type module struct {
+	t     *Template
+	attrs map[string]interface{}
+}
+
+func (m *module) getattr(name string) (interface{}, bool) {
+	v, ok := m.attrs[name]
+	return v, ok
+}
+
+func (m *module) String() string {
+	return fmt.Sprintf("<module %s>", m.t.Name)
+}
+
+// group is a group of items produced by the groupby filter.  It has the
+// attributes grouper and list, and can be unpacked as `grouper, list`.
+type group []interface{}
+
+func (g group) getattr(name string) (interface{}, bool) {
+	switch name {
+	case "grouper":
+		return g[0], true
+	case "list":
+		return g[1], true
+	}
+	return nil, false
+}
+
+// undefined is the value of names and attributes which are not defined.  It
+// renders as an empty string, is false, and iterates as an empty sequence.
+type undefined struct {
+	name string
+}
+
+func (u undefined) String() string { return "" }
+
+// isUndefined returns whether v is an undefined value.
+func isUndefined(v interface{}) bool {
+	_, ok := v.(undefined)
+	return ok
+}
@@ -0,0 +1,266 @@
+package jigo
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// This file contains the sandbox, which restricts what templates may access
+// so that untrusted templates can be rendered safely.
+
+// A Policy decides which fields and methods of Go values the templates of a
+// sandboxed environment may access.  Unexported fields and methods are never
+// accessible, whatever the policy.
+type Policy interface {
+	// AllowField reports whether templates may read the field name of the
+	// struct type t.
+	AllowField(t reflect.Type, name string) bool
+	// AllowMethod reports whether templates may call the method name of the
+	// type t, which may be a pointer type.
+	AllowMethod(t reflect.Type, name string) bool
+}
+
+// SandboxPolicy is the Policy of environments made by NewSandboxedEnvironment.
+// It allows fields and denies methods, except for those it lists.  Types are
+// named as by reflect.Type's String method, without any leading `*`, eg.
+// "time.Time".
+type SandboxPolicy struct {
+	// Methods lists the methods templates may call, as "Type.Method", eg.
+	// "time.Time.Format".
+	Methods []string
+	// DeniedNames lists names of fields and methods which are denied on
+	// every type.
+	DeniedNames []string
+	// DeniedTypes lists types whose fields and methods are all denied.
+	DeniedTypes []string
+}
+
+// typeName returns the name of t for a SandboxPolicy.
+func typeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.String()
+}
+
+// listed returns whether s is in list.
+func listed(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// denied returns whether the policy denies all access to the field or
+// method name of t.
+func (p *SandboxPolicy) denied(t reflect.Type, name string) bool {
+	return listed(p.DeniedNames, name) || listed(p.DeniedTypes, typeName(t))
+}
+
+func (p *SandboxPolicy) AllowField(t reflect.Type, name string) bool {
+	return !p.denied(t, name)
+}
+
+func (p *SandboxPolicy) AllowMethod(t reflect.Type, name string) bool {
+	return !p.denied(t, name) && listed(p.Methods, typeName(t)+"."+name)
+}
+
+// NewSandboxedEnvironment returns a new environment whose templates are
+// sandboxed by an empty SandboxPolicy, which allows them to read fields but
+// not to call methods.  The policy may be changed by setting the
+// environment's Sandbox.
+func NewSandboxedEnvironment() *Environment {
+	e := NewEnvironment()
+	e.Sandbox = &SandboxPolicy{}
+	return e
+}
+
+// A SecurityError is returned when a sandboxed template accesses something
+// its environment's policy does not allow.
+type SecurityError struct {
+	// Location is where in the template the access was made, eg.
+	// "name:1:10".
+	Location string
+	// Reason describes what was denied.
+	Reason string
+}
+
+func (e *SecurityError) Error() string {
+	return fmt.Sprintf("template: %s: %s", e.Location, e.Reason)
+}
+
+// IsSecurity reports whether err is the result of a sandboxed template
+// accessing something it is not allowed to.
+func IsSecurity(err error) bool {
+	var se *SecurityError
+	return errors.As(err, &se)
+}
+
+// denied returns err located at n.
+func (r *renderer) denied(n Node, err *SecurityError) error {
+	err.Location, _ = r.t.base.ErrorContext(n)
+	return err
+}
+
+// checkAttr returns a *SecurityError without a location if policy does not
+// allow access to the field or method name of t.
+func checkAttr(policy Policy, t reflect.Type, name string, isMethod bool) error {
+	switch {
+	case isMethod && !policy.AllowMethod(t, name):
+		return &SecurityError{Reason: fmt.Sprintf("method %s of %s is not allowed", name, t)}
+	case !isMethod && !policy.AllowField(t, name):
+		return &SecurityError{Reason: fmt.Sprintf("field %s of %s is not allowed", name, t)}
+	}
+	return nil
+}
+
+// printMethod is a method which fmt or encoding/json call to print values
+// which implement iface.
+type printMethod struct {
+	iface reflect.Type
+	name  string
+}
+
+// fmtMethods and jsonMethods are the methods fmt and encoding/json call to
+// print values, in the order they prefer them.
+var (
+	fmtMethods = []printMethod{
+		{reflect.TypeOf((*fmt.Formatter)(nil)).Elem(), "Format"},
+		{errorType, "Error"},
+		{reflect.TypeOf((*fmt.Stringer)(nil)).Elem(), "String"},
+	}
+	jsonMethods = []printMethod{
+		{reflect.TypeOf((*json.Marshaler)(nil)).Elem(), "MarshalJSON"},
+		{reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem(), "MarshalText"},
+	}
+)
+
+// maxPrintDepth is how deeply values may be nested to be printed in a
+// sandbox, which stops checkPrint on cyclic values.
+const maxPrintDepth = 100
+
+// printingFilters are the builtin filters which print their value or
+// arguments, which in a sandbox must be printable.  The join filter checks
+// its items itself, since it may print an attribute of each of them instead.
+var printingFilters = map[string]bool{
+	"capitalize": true, "center": true, "e": true, "escape": true,
+	"float": true, "format": true, "indent": true, "int": true,
+	"lower": true, "replace": true, "safe": true, "string": true,
+	"striptags": true, "title": true, "tojson": true, "trim": true,
+	"truncate": true, "upper": true, "urlencode": true, "wordcount": true,
+	"wordwrap": true, "xmlattr": true,
+}
+
+// printable returns a *SecurityError without a location if a sandboxed
+// template may not print vals, or serialize them to JSON if json is true.
+func (e *Environment) printable(json bool, vals ...interface{}) error {
+	if e.Sandbox == nil {
+		return nil
+	}
+	for _, v := range vals {
+		if err := checkPrint(e.Sandbox, reflect.ValueOf(v), json, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPrint returns a *SecurityError without a location if policy does not
+// allow v to be printed, or serialized to JSON if json is true.  Scalars and
+// values made of them may be printed, as may values with a String method, or
+// a MarshalJSON method for JSON, which the policy allows.  Other structs may
+// not, since printing them would reveal all of their fields.
+func checkPrint(policy Policy, v reflect.Value, json bool, depth int) error {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	if depth > maxPrintDepth {
+		return &SecurityError{Reason: "value is too deeply nested to print"}
+	}
+	switch x := v.Interface().(type) {
+	case undefined, Markup, attributes, *macro, method, builtin, *loopContext, *module:
+		return nil
+	case *namespace:
+		return checkPrint(policy, reflect.ValueOf(x.attrs), json, depth+1)
+	}
+	t := v.Type()
+	methods := fmtMethods
+	if json {
+		methods = jsonMethods
+	}
+	for _, m := range methods {
+		if t.Implements(m.iface) {
+			if !policy.AllowMethod(t, m.name) {
+				return &SecurityError{Reason: fmt.Sprintf("method %s of %s is not allowed", m.name, t)}
+			}
+			return nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return &SecurityError{Reason: fmt.Sprintf("printing %s is not allowed", t)}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return checkPrint(policy, v.Elem(), json, depth+1)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := checkPrint(policy, v.Index(i), json, depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			if err := checkPrint(policy, k, json, depth+1); err != nil {
+				return err
+			}
+			if err := checkPrint(policy, v.MapIndex(k), json, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// method is a method value which a sandbox policy allows to be called.  In
+// sandboxed templates, other Go functions may only be called if they are in
+// the environment's Globals.
+type method struct {
+	fn reflect.Value
+}
+
+func (m method) String() string { return fmt.Sprint(m.fn.Interface()) }
+
+// builtin is a function provided by jigo itself, like `loop.cycle`, `super`
+// and `namespace`, which sandboxed templates may always call.
+type builtin struct {
+	fn interface{}
+}
+
+func (b builtin) String() string { return fmt.Sprint(b.fn) }
+
+// allowCall returns an error if a sandboxed template may not call fn.
+func (e *Environment) allowCall(fn interface{}) error {
+	if e.Sandbox == nil {
+		return nil
+	}
+	switch fn.(type) {
+	case *macro, method, builtin:
+		return nil
+	}
+	f := reflect.ValueOf(fn)
+	for _, g := range e.Globals {
+		if g := reflect.ValueOf(g); g.Kind() == reflect.Func && g.Type() == f.Type() && g.Pointer() == f.Pointer() {
+			return nil
+		}
+	}
+	return &SecurityError{Reason: "only functions in Globals may be called"}
+}
@@ -0,0 +1,217 @@
+package jigo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// This file contains the builtin tests, which match the builtin tests of
+// Jinja2.
+
+// builtinTests returns the default tests for an environment.
+func builtinTests() map[string]interface{} {
+	return map[string]interface{}{
+		"defined":     testDefined,
+		"undefined":   testUndefined,
+		"none":        testNone,
+		"boolean":     testBoolean,
+		"true":        testTrue,
+		"false":       testFalse,
+		"integer":     testInteger,
+		"float":       testFloat,
+		"number":      testNumber,
+		"string":      testString,
+		"mapping":     testMapping,
+		"sequence":    testSequence,
+		"iterable":    testIterable,
+		"callable":    testCallable,
+		"even":        testEven,
+		"odd":         testOdd,
+		"divisibleby": testDivisibleby,
+		"eq":          testEq,
+		"equalto":     testEq,
+		"==":          testEq,
+		"ne":          testNe,
+		"!=":          testNe,
+		"lt":          testLt,
+		"lessthan":    testLt,
+		"<":           testLt,
+		"le":          testLe,
+		"<=":          testLe,
+		"gt":          testGt,
+		"greaterthan": testGt,
+		">":           testGt,
+		"ge":          testGe,
+		">=":          testGe,
+		"in":          testIn,
+		"lower":       testLower,
+		"upper":       testUpper,
+		"sameas":      testSameas,
+		"escaped":     testEscaped,
+	}
+}
+
+// test calls the test called name with v and any extra arguments.
+func (e *Environment) test(name string, v interface{}, args []interface{}, kwargs map[string]interface{}) (bool, error) {
+	fn, ok := e.Tests[name]
+	if !ok {
+		return false, fmt.Errorf("no test named %q", name)
+	}
+	result, err := callFunc(fn, append([]interface{}{v}, args...), kwargs)
+	if err != nil {
+		return false, fmt.Errorf("test %s: %s", name, err)
+	}
+	b, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("test %s returned %T, not bool", name, result)
+	}
+	return b, nil
+}
+
+// equal returns whether a and b are equal.  Values which can be compared
+// with compare are equal if they compare equal, and other values if they are
+// deeply equal.
+func equal(a, b interface{}) bool {
+	if c, err := compare(a, b); err == nil {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// contains returns whether the container c contains v.  Strings contain
+// their substrings, maps contain their keys and sequences their items.
+func contains(c, v interface{}) (bool, error) {
+	if s, ok := c.(string); ok {
+		sub, ok := v.(string)
+		if !ok {
+			return false, fmt.Errorf("cannot search for %T in a string", v)
+		}
+		return strings.Contains(s, sub), nil
+	}
+	items, err := iterate(c)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range items {
+		if equal(item, v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func testDefined(v interface{}) bool   { return !isUndefined(v) }
+func testUndefined(v interface{}) bool { return isUndefined(v) }
+func testNone(v interface{}) bool      { return v == nil }
+func testBoolean(v interface{}) bool   { return typeOf(v) == boolType }
+func testTrue(v interface{}) bool      { return v == true }
+func testFalse(v interface{}) bool     { return v == false }
+func testInteger(v interface{}) bool   { return typeOf(v) == intType }
+func testFloat(v interface{}) bool     { return typeOf(v) == floatType }
+func testNumber(v interface{}) bool    { return isNumericVar(typeOf(v)) }
+func testString(v interface{}) bool    { return typeOf(v) == stringType }
+
+func testMapping(v interface{}) bool {
+	return v != nil && reflect.TypeOf(v).Kind() == reflect.Map
+}
+
+// testSequence returns whether v has a length and can be indexed, ie. it
+// is a string, slice, array or map.
+func testSequence(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
+
+func testIterable(v interface{}) bool {
+	if _, ok := v.(string); ok {
+		return true
+	}
+	_, err := iterate(v)
+	return err == nil && v != nil && !isUndefined(v)
+}
+
+func testCallable(v interface{}) bool { return callable(v) }
+
+func testEven(v int64) bool { return v%2 == 0 }
+func testOdd(v int64) bool  { return v%2 != 0 }
+
+func testDivisibleby(v, n int64) (bool, error) {
+	if n == 0 {
+		return false, fmt.Errorf("division by zero")
+	}
+	return v%n == 0, nil
+}
+
+func testEq(a, b interface{}) bool { return equal(a, b) }
+func testNe(a, b interface{}) bool { return !equal(a, b) }
+
+func testLt(a, b interface{}) (bool, error) {
+	c, err := compare(a, b)
+	return c < 0, err
+}
+
+func testLe(a, b interface{}) (bool, error) {
+	c, err := compare(a, b)
+	return c <= 0, err
+}
+
+func testGt(a, b interface{}) (bool, error) {
+	c, err := compare(a, b)
+	return c > 0, err
+}
+
+func testGe(a, b interface{}) (bool, error) {
+	c, err := compare(a, b)
+	return c >= 0, err
+}
+
+func testIn(v, c interface{}) (bool, error) { return contains(c, v) }
+
+// hasCased returns whether s has any upper or lower case letters.
+func hasCased(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return unicode.IsUpper(r) || unicode.IsLower(r) }) >= 0
+}
+
+func testLower(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && hasCased(s) && s == strings.ToLower(s)
+}
+
+func testUpper(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && hasCased(s) && s == strings.ToUpper(s)
+}
+
+// testSameas returns whether a and b are the same object.  Pointers, maps,
+// slices and funcs are the same if they point to the same data, and other
+// values if they are equal.
+func testSameas(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Type() != vb.Type() {
+		return false
+	}
+	switch va.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return va.Pointer() == vb.Pointer()
+	case reflect.Slice:
+		return va.Pointer() == vb.Pointer() && va.Len() == vb.Len()
+	}
+	return va.Type().Comparable() && a == b
+}
+
+// testEscaped returns whether v is already safe HTML.
+func testEscaped(v interface{}) bool {
+	_, ok := asSafe(v)
+	return ok
+}
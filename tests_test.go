@@ -0,0 +1,69 @@
+package jigo
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestBuiltinTests(t *testing.T) {
+	fn := func() {}
+	list := []int{1, 2}
+	fixtures := []evalFixture{
+		{"defined", `{{ x is defined }} {{ y is defined }} {{ y is undefined }} {{ x is not defined }}`, m{"x": 1}, "true false true false"},
+		{"defined attr", `{{ u.name is defined }} {{ u.age is defined }}`, m{"u": m{"name": "x"}}, "true false"},
+		{"none", `{{ n is none }} {{ x is none }} {{ x is not none }} {{ y is none }}`, m{"n": nil, "x": 0}, "true false true false"},
+		{"boolean", `{{ true is boolean }} {{ 1 is boolean }} {{ b is true }} {{ b is false }} {{ 1 is true }}`, m{"b": false}, "true false false true false"},
+		{"numbers", `{{ 1 is integer }} {{ 1.5 is integer }} {{ 1.5 is float }} {{ 1 is number }} {{ "1" is number }}`, m{}, "true false true true false"},
+		{"string", `{{ "a" is string }} {{ 1 is string }}`, m{}, "true false"},
+		{"collections", `{{ d is mapping }} {{ l is mapping }} {{ l is sequence }} {{ "a" is sequence }} {{ 1 is sequence }} {{ l is iterable }} {{ 1 is iterable }}`, m{"d": m{}, "l": []int{}}, "true false true true false true false"},
+		{"callable", `{{ f is callable }} {{ x is callable }}`, m{"f": fn, "x": 1}, "true false"},
+		{"even odd", `{{ 2 is even }} {{ 3 is even }} {{ 3 is odd }} {{ n is odd }}`, m{"n": uint8(7)}, "true false true true"},
+		{"divisibleby", `{{ 9 is divisibleby(3) }} {{ 9 is divisibleby 4 }} {{ n is not divisibleby 5 }}`, m{"n": 10}, "true false false"},
+		{"comparisons", `{{ 1 is eq 1 }} {{ 1 is eq(1.0) }} {{ 1 is ne 2 }} {{ 1 is lt 2 }} {{ 2 is le 2 }} {{ 3 is gt 2 }} {{ 2 is ge 3 }}`, m{}, "true true true true true true false"},
+		{"eq string", `{{ "a" is eq "a" }} {{ "a" is eq 1 }}`, m{}, "true false"},
+		{"in", `{{ 2 is in l }} {{ 3 is in l }} {{ "ell" is in "hello" }} {{ "k" is in d }}`, m{"l": []int{1, 2}, "d": m{"k": 1}}, "true false true true"},
+		{"case", `{{ "abc" is lower }} {{ "aBc" is lower }} {{ "ABC" is upper }} {{ "123" is upper }}`, m{}, "true false true false"},
+		{"sameas", `{{ a is sameas b }} {{ a is sameas c }} {{ n is sameas none }} {{ 1 is sameas 1 }}`, m{"a": list, "b": list, "c": []int{1, 2}, "n": nil}, "true false true true"},
+		{"escaped", `{{ h is escaped }} {{ s is escaped }}`, m{"h": template.HTML("<b>"), "s": "<b>"}, "true false"},
+		{"test filter", `{{ l|length is even }}`, m{"l": []int{1, 2}}, "true"},
+		{"test in condition", `{% if x is defined %}yes{% else %}no{% endif %}`, m{}, "no"},
+		{"select test", `{{ l|select("odd")|join }} {{ l|reject("odd")|join }} {{ l|select("divisibleby", 3)|join }}`, m{"l": []int{1, 2, 3, 4, 5, 6}}, "135 246 36"},
+		{"selectattr test", `{{ l|selectattr("n", "gt", 1)|map(attribute="n")|join }} {{ l|rejectattr("x", "defined")|map(attribute="n")|join }}`, m{"l": []m{{"n": 1, "x": 0}, {"n": 2}}}, "2 2"},
+		{"selectattr equalto", `{{ l|selectattr("n", "equalto", 1)|map(attribute="n")|join }}`, m{"l": []m{{"n": 1}, {"n": 2}}}, "1"},
+	}
+	testFixtures(t, NewEnvironment(), fixtures)
+
+	e := NewEnvironment()
+	e.Tests["prime"] = func(n int) bool {
+		for i := 2; i < n; i++ {
+			if n%i == 0 {
+				return false
+			}
+		}
+		return n > 1
+	}
+	testFixtures(t, e, []evalFixture{
+		{"custom test", `{{ 7 is prime }} {{ 8 is prime }} {{ l|select("prime")|join(",") }}`, m{"l": []int{2, 3, 4, 5}}, "true false 2,3,5"},
+	})
+}
+
+func TestTestErrors(t *testing.T) {
+	e := NewEnvironment()
+	e.Tests["notbool"] = func(v interface{}) int { return 1 }
+	for _, source := range []string{
+		`{{ x is nope }}`,
+		`{{ x is not }}`,
+		`{{ x is 1 }}`,
+	} {
+		if _, err := e.ParseString(source, "test", "test"); err == nil {
+			t.Errorf("%s: expected parse error", source)
+		}
+	}
+	testRenderErrors(t, e, []string{
+		`{{ 1 is divisibleby 0 }}`,
+		`{{ "a" is even }}`,
+		`{{ 1 is lt "a" }}`,
+		`{{ 1 is notbool }}`,
+		`{{ l|select("nope")|join }}`,
+	}, m{"l": []int{1}})
+}
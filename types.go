@@ -3,6 +3,7 @@ package jigo
 import (
 	"fmt"
 	"reflect"
+	"sort"
 )
 
 // vartype is a simplified version of the notion of Kind in reflect, modified
@@ -55,6 +56,9 @@ func typeOf(i interface{}) vartype {
 	}
 	kind := reflect.ValueOf(i).Kind()
 	switch kind {
+	case reflect.String:
+		// named string types like Markup are strings
+		return stringType
 	case reflect.Slice, reflect.Array:
 		return sliceType
 	case reflect.Map:
@@ -134,3 +138,136 @@ func asFloat(i interface{}) (float64, bool) {
 func asString(i interface{}) string {
 	return fmt.Sprint(i)
 }
+
+// iterate returns the items of an iterable value.  Slices and arrays yield
+// their elements, maps yield their keys in sorted order, and channels are
+// received from until they are closed.  nil and undefined values have no
+// items.
+func iterate(i interface{}) ([]interface{}, error) {
+	if i == nil || isUndefined(i) {
+		return nil, nil
+	}
+	v := reflect.ValueOf(i)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, v.Len())
+		for j := range items {
+			items[j] = v.Index(j).Interface()
+		}
+		return items, nil
+	case reflect.Map:
+		keys := sortedKeys(v)
+		items := make([]interface{}, len(keys))
+		for j, k := range keys {
+			items[j] = k.Interface()
+		}
+		return items, nil
+	case reflect.Chan:
+		if v.Type().ChanDir()&reflect.RecvDir == 0 {
+			return nil, fmt.Errorf("cannot iterate over send-only %s", v.Type())
+		}
+		var items []interface{}
+		for {
+			x, ok := v.Recv()
+			if !ok {
+				return items, nil
+			}
+			items = append(items, x.Interface())
+		}
+	}
+	return nil, fmt.Errorf("cannot iterate over %T", i)
+}
+
+// sortedKeys returns the keys of the map v in sorted order.  Numeric keys
+// are sorted numerically, and all others by their string representation.
+func sortedKeys(v reflect.Value) []reflect.Value {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i].Interface(), keys[j].Interface()
+		if isNumericVar(typeOf(a)) && isNumericVar(typeOf(b)) {
+			x, _ := asFloat(a)
+			y, _ := asFloat(b)
+			return x < y
+		}
+		return asString(a) < asString(b)
+	})
+	return keys
+}
+
+// unpack unpacks a sequence into exactly n values.
+func unpack(i interface{}, n int) ([]interface{}, error) {
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("cannot unpack %T into %d values", i, n)
+	}
+	if v.Len() != n {
+		return nil, fmt.Errorf("cannot unpack %d values into %d", v.Len(), n)
+	}
+	items := make([]interface{}, n)
+	for j := range items {
+		items[j] = v.Index(j).Interface()
+	}
+	return items, nil
+}
+
+// truthy returns whether i is considered true by filters which test the
+// truth of values, like select and default with boolean=true.  nil, undefined,
+// false, numeric zero and empty strings, slices and maps are false, and every
+// other value is true.  Template conditions are stricter, and see evalBool.
+func truthy(i interface{}) bool {
+	if i == nil || isUndefined(i) {
+		return false
+	}
+	switch typeOf(i) {
+	case boolType:
+		return reflect.ValueOf(i).Bool()
+	case intType:
+		n, _ := asInteger(i)
+		return n != 0
+	case floatType:
+		f, _ := asFloat(i)
+		return f != 0
+	}
+	v := reflect.ValueOf(i)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return v.Len() > 0
+	case reflect.Ptr, reflect.Interface, reflect.Func:
+		return !v.IsNil()
+	}
+	return true
+}
+
+// compare compares two values, returning -1, 0 or 1 if a is less than, equal
+// to or greater than b.  Numbers are compared numerically, and strings and
+// bools with values of the same type.  Other values cannot be compared.
+func compare(a, b interface{}) (int, error) {
+	at, bt := typeOf(a), typeOf(b)
+	switch {
+	case at == intType && bt == intType:
+		x, _ := asInteger(a)
+		y, _ := asInteger(b)
+		return compareOrdered(x < y, x > y), nil
+	case isNumericVar(at) && isNumericVar(bt):
+		x, _ := asFloat(a)
+		y, _ := asFloat(b)
+		return compareOrdered(x < y, x > y), nil
+	case at == stringType && bt == stringType:
+		x, y := asString(a), asString(b)
+		return compareOrdered(x < y, x > y), nil
+	case at == boolType && bt == boolType:
+		x, y := reflect.ValueOf(a).Bool(), reflect.ValueOf(b).Bool()
+		return compareOrdered(!x && y, x && !y), nil
+	}
+	return 0, fmt.Errorf("cannot compare %s and %s", at, bt)
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}